@@ -3,53 +3,83 @@ package firestorm
 import (
 	"cloud.google.com/go/firestore"
 	"context"
-	"errors"
-	"log"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var transCacheKey = contextKey("transactionCache")
+var outerCtxKey = contextKey("outerContext")
+var preconditionCtxKey = contextKey("transactionPrecondition")
 
 // DoInTransaction wraps any updates that needs to run in a transaction.
 // Use the transaction context tctx  for any calls that need to be part of the transaction.
-// Do reads before writes as required by firestore
+// Do reads before writes as required by firestore.
+// A TransactionAbortedError is returned if firestore aborts the transaction, an AlreadyExistsError
+// if one of the created entities already exists and a ConflictError if a precondition of a write fails.
 func (fsc *FSClient) DoInTransaction(ctx context.Context, f func(tctx context.Context) error) error {
 	// if nested transaction - reuse existing transaction and cache
 	if _, ok := getTransaction(ctx); ok {
 		return f(ctx)
 	}
+	var written []string
+	precondition := &atomic.Bool{}
 	err := fsc.Client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		// only the writes of the last attempt are committed
+		precondition.Store(false)
 		// add a new cache to context
-		cache := newDefaultCache()
+		cache := newTransactionCache()
 		tctx := context.WithValue(ctx, transactionCtxKey, t)
 		tctx = context.WithValue(tctx, SessionCacheKey, make(map[string]EntityMap))
-		tctx = context.WithValue(tctx, transCacheKey, newCacheWrapper(fsc.Client, cache, nil))
+		tcache := newCacheWrapper(fsc.Client, cache, nil)
+		tcache.stats = fsc.Cache.stats
+		tctx = context.WithValue(tctx, transCacheKey, tcache)
+		tctx = context.WithValue(tctx, outerCtxKey, ctx)
+		tctx = context.WithValue(tctx, preconditionCtxKey, precondition)
 
 		// do the updates
 		if err := f(tctx); err != nil {
 			return err
 		}
 
-		// update cache with transaction cache. For now we just delete all modified keys
-		if err := fsc.getCache(ctx).SetMulti(ctx, cache.getSetRec(tctx)); err != nil {
-			log.Printf("Could not set values in cache: %#v", err)
+		// update cache with transaction cache. Only the written entities are flushed to the second level cache
+		// while the entities only read are kept in the session
+		if err := fsc.getCache(ctx).setFirstMulti(ctx, cache.getReadRec(tctx)); err != nil {
+			fsc.log(ctx, LevelError, "Could not set values in cache", "op", "transaction", "err", err)
+		}
+		if err := fsc.getCache(ctx).EvictMulti(ctx, cache.getEvictRec()); err != nil {
+			fsc.log(ctx, LevelError, "Could not evict keys from cache", "op", "transaction", "err", err)
+		}
+		if err := fsc.getCache(ctx).WriteMulti(ctx, cache.getSetRec(tctx)); err != nil {
+			fsc.log(ctx, LevelError, "Could not set values in cache", "op", "transaction", "err", err)
 		}
 		if err := fsc.getCache(ctx).DeleteMulti(ctx, cache.getDeleteRec(tctx)); err != nil {
-			log.Printf("Could not delete keys from cache: %#v", err)
+			fsc.log(ctx, LevelError, "Could not delete keys from cache", "op", "transaction", "err", err)
+		}
+		patched := cache.getPatchRec(tctx)
+		if err := fsc.getCache(ctx).setFirstMulti(ctx, patched); err != nil {
+			fsc.log(ctx, LevelError, "Could not set values in cache", "op", "transaction", "err", err)
 		}
+		if err := fsc.getCache(ctx).deleteSecondMulti(ctx, mapKeys(patched)); err != nil {
+			fsc.log(ctx, LevelError, "Could not evict keys from cache", "op", "transaction", "err", err)
+		}
+		written = cache.getWrittenRec()
 
 		return nil
 	})
-	return err
+	if err == nil {
+		// invalidate the cached queries and the other clients when the writes are committed
+		fsc.invalidateCommitted(ctx, written)
+	}
+	return toTransactionError(err, precondition.Load())
 }
 
 func (fsc *FSClient) getEntities(ctx context.Context, req *Request, sliceVal reflect.Value) func() ([]interface{}, error) {
 	slice := sliceVal
 	result := make([]interface{}, 0, slice.Len())
 	asyncFunc := func() error {
-		var nfErr error
+		nfRefs := make(map[string]*firestore.DocumentRef)
 		refs := make([]*firestore.DocumentRef, slice.Len())
 		for i := 0; i < slice.Len(); i++ {
 			refs[i] = req.ToRef(slice.Index(i).Interface())
@@ -64,21 +94,37 @@ func (fsc *FSClient) getEntities(ctx context.Context, req *Request, sliceVal ref
 
 		if err != nil {
 			if err, ok := err.(NotFoundError); ok {
-				nfErr = err
+				nfRefs = err.Refs
 			} else {
 				return err
 			}
 		}
 
+		var errs []EntityError
 		for i, v := range res {
 			if len(v) > 0 {
-				fsc.MapFromDB.MapToStruct(v, slice.Index(i).Interface())
-				result = append(result, slice.Index(i).Interface())
+				entity := slice.Index(i).Interface()
+				if key, ok := fsc.deletedAtKey(reflect.TypeOf(entity)); ok && !req.includeDeleted && isDeleted(v, key) {
+					nfRefs[refs[i].Path] = refs[i] // soft deleted
+					continue
+				}
+				fsc.fromDB(v, entity)
+				if err := afterLoad(ctx, entity); err != nil {
+					errs = append(errs, EntityError{Index: i, Entity: entity, Ref: refs[i], Err: err})
+					continue
+				}
+				result = append(result, entity)
 			}
 		}
-		return nfErr
+		if len(errs) > 0 {
+			return multiErrorOrNil(errs)
+		}
+		if len(nfRefs) > 0 {
+			return newNotFoundError(nfRefs)
+		}
+		return nil
 	}
-	af := runAsync(ctx, asyncFunc)
+	af := fsc.runRead(ctx, asyncFunc)
 	return func() (entities []interface{}, e error) {
 		err := af()
 		return result, err
@@ -90,8 +136,9 @@ func (fsc *FSClient) getCachedEntities(ctx context.Context, refs []*firestore.Do
 	load := make([]*firestore.DocumentRef, 0, len(refs))
 
 	// check cache and collect refs not loaded yet
+	fsc.warnNoSessionCache(ctx)
 	if getMulti, err := fsc.getCache(ctx).GetMulti(ctx, refs); err != nil {
-		log.Printf("Cache error but continue: %+v", err)
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "get", "paths", refPaths(refs), "err", err)
 		load = append(load, refs...)
 	} else {
 		for i, ref := range refs {
@@ -104,17 +151,30 @@ func (fsc *FSClient) getCachedEntities(ctx context.Context, refs []*firestore.Do
 	}
 
 	// get the unloaded refs
-	docs, err := getAll(ctx, fsc.Client, load)
+	docs, shared, err := fsc.loadDocs(ctx, load)
 	if err != nil {
 		return nil, err
 	}
+	avoided := len(refs) - len(load)
+	for _, s := range shared {
+		if s {
+			avoided++
+		}
+	}
+	fsc.getCache(ctx).stats.avoided(avoided)
 
 	// fill the res slice with the DB results
 	i := 0
 	multi := make(map[string]EntityMap, len(docs))
-	for _, doc := range docs {
-		ref := newCacheRef(doc.Data(), doc.Ref)
-		multi[doc.Ref.Path] = doc.Data()
+	sharedMulti := make(map[string]EntityMap)
+	for j, doc := range docs {
+		ref := newCacheRef(withMetadata(doc.Data(), docMetadata(doc)), doc.Ref)
+		if shared[j] {
+			// the request that read the document fills the second level cache
+			sharedMulti[doc.Ref.Path] = withMetadata(doc.Data(), docMetadata(doc))
+		} else {
+			multi[doc.Ref.Path] = withMetadata(doc.Data(), docMetadata(doc))
+		}
 		for _, v := range res[i:] {
 			if v.Ref == nil {
 				res[i] = ref
@@ -125,172 +185,182 @@ func (fsc *FSClient) getCachedEntities(ctx context.Context, refs []*firestore.Do
 		}
 	}
 	if err = fsc.getCache(ctx).SetMulti(ctx, multi); err != nil {
-		log.Printf("Cache error but continue: %+v", err)
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "get", "paths", mapKeys(multi), "err", err)
+	}
+	if err = fsc.getCache(ctx).setFirstMulti(ctx, sharedMulti); err != nil {
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "get", "paths", mapKeys(sharedMulti), "err", err)
 	}
 	return res, nil
 }
 
 func (fsc *FSClient) queryEntities(ctx context.Context, req *Request, p firestore.Query, toSlicePtr interface{}) FutureFunc {
+	p = fsc.withoutDeletedQuery(req, p, toSlicePtr)
 	asyncFunc := func() error {
+		var collection, key string
+		var generation int
+		_, inTransaction := getTransaction(ctx)
+		cacheQuery := false
+		if req.queryTTL > 0 && !inTransaction {
+			if collection, key, cacheQuery = queryKey(p); cacheQuery {
+				paths, gen, ok := fsc.queries.get(collection, key)
+				fsc.Cache.stats.query(ok)
+				if ok {
+					if refs, res, err := fsc.cachedQueryEntities(ctx, req, paths); err == nil {
+						// the cached entities may have been deleted by another client since
+						if key, ok := fsc.deletedAtKey(reflect.TypeOf(toSlicePtr)); ok && !req.includeDeleted {
+							refs, res = withoutDeleted(refs, res, key)
+						}
+						return fsc.toEntities(ctx, refs, res, toSlicePtr)
+					}
+				}
+				generation = gen
+			}
+		}
+
 		docs, err := query(ctx, p)
 		if err != nil {
 			return err
 		}
+		if cacheQuery {
+			paths := make([]string, len(docs))
+			for i, doc := range docs {
+				paths[i] = doc.Ref.Path
+			}
+			fsc.queries.set(collection, key, generation, paths, req.queryTTL)
+		}
 		multi := make(map[string]EntityMap, len(docs))
 		for _, doc := range docs {
-			multi[doc.Ref.Path] = doc.Data()
+			multi[doc.Ref.Path] = withMetadata(doc.Data(), docMetadata(doc))
 		}
 		if err = fsc.getCache(ctx).SetMulti(ctx, multi); err != nil {
-			log.Printf("Cache error but continue: %+v", err)
+			fsc.log(ctx, LevelError, "Cache error but continue", "op", "query", "paths", mapKeys(multi), "err", err)
 		}
 		resolver := newResolver(fsc, req.loadPaths...)
 		res, err := resolver.ResolveDocs(ctx, docs)
 		if err != nil {
 			return err
 		}
-		return fsc.toEntities(ctx, res, toSlicePtr)
+		refs := make([]*firestore.DocumentRef, len(docs))
+		for i, doc := range docs {
+			refs[i] = doc.Ref
+		}
+		return fsc.toEntities(ctx, refs, res, toSlicePtr)
+	}
+	return fsc.runRead(ctx, asyncFunc)
+}
+
+// cachedQueryEntities loads the entities of a cached query result. The entities are read from the cache if possible.
+// An error is returned if the entities could not be loaded so the query is run instead
+func (fsc *FSClient) cachedQueryEntities(ctx context.Context, req *Request, paths []string) ([]*firestore.DocumentRef, []entityMap, error) {
+	refs := make([]*firestore.DocumentRef, len(paths))
+	for i, path := range paths {
+		refs[i] = fsc.Client.Doc(strings.SplitN(path, "/documents/", 2)[1])
 	}
-	return runAsync(ctx, asyncFunc)
+	crefs, err := fsc.getCachedEntities(ctx, refs)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := newResolver(fsc, req.loadPaths...).ResolveCacheRef(ctx, crefs)
+	return refs, res, err
 }
 
 func (fsc *FSClient) createEntity(ctx context.Context, req *Request, entity interface{}) FutureFunc {
+	if len(req.cascadePaths) > 0 {
+		return fsc.createEntities(ctx, req, reflect.ValueOf([]interface{}{entity}))
+	}
 	asyncFunc := func() error {
-		m, err := fsc.MapToDB.StructToMap(entity)
+		w, err := fsc.toCreateWrite(ctx, req, entity)
 		if err != nil {
 			return err
 		}
-
-		ref := req.ToRef(entity)
-		// if we need a fixed ID use that
-		if req.GetID(entity) == "" {
-			ref = req.ToCollection(entity).NewDoc() // otherwise create new id
-			req.SetID(entity, ref.ID)
-		}
-		req.mapperFunc(m)
-		if err := create(ctx, ref, m); err != nil {
-			return err
-		}
-		if err := fsc.getCache(ctx).Set(ctx, ref.Path, m); err != nil {
-			log.Printf("Cache error but continue: %+v", err)
-		}
-		return nil
+		return fsc.applyWrite(ctx, w)
 	}
-	return runAsync(ctx, asyncFunc)
+	return fsc.runWrite(ctx, asyncFunc)
 }
 
 func (fsc *FSClient) createEntities(ctx context.Context, req *Request, sliceVal reflect.Value) FutureFunc {
-	asyncFunc := func() error {
-		slice := sliceVal
-		futures := make([]FutureFunc, slice.Len())
-		var errs []string
-
-		// kick off all updates and collect futures
-		for i := 0; i < slice.Len(); i++ {
-			futures[i] = fsc.createEntity(ctx, req, slice.Index(i).Interface())
-		}
-
-		// wait for all futures to finish
-		for _, f := range futures {
-			if err := f(); err != nil {
-				errs = append(errs, err.Error())
-			}
-		}
-
-		// check the errors
-		if len(errs) > 0 {
-			return errors.New(strings.Join(errs, "\n"))
-		}
-		return nil
+	toWrite := func(entity interface{}) (write, error) {
+		return fsc.toCreateWrite(ctx, req, entity)
 	}
-	return runAsync(ctx, asyncFunc)
+	if len(req.cascadePaths) > 0 {
+		return fsc.cascadeEntities(ctx, req, sliceVal, toWrite)
+	}
+	return fsc.writeEntities(ctx, req, sliceVal, toWrite)
 }
 
 func (fsc *FSClient) updateEntity(ctx context.Context, req *Request, entity interface{}) FutureFunc {
+	if len(req.cascadePaths) > 0 {
+		return fsc.updateEntities(ctx, req, reflect.ValueOf([]interface{}{entity}))
+	}
 	asyncFunc := func() error {
-		m, err := fsc.MapToDB.StructToMap(entity)
+		w, err := fsc.toSetWrite(ctx, req, entity)
 		if err != nil {
 			return err
 		}
-
-		ref := req.ToRef(entity)
-		req.mapperFunc(m)
-		if err := set(ctx, ref, m); err != nil {
-			return err
-		}
-		if err := fsc.getCache(ctx).Set(ctx, ref.Path, m); err != nil {
-			log.Printf("Cache error but continue: %+v", err)
-		}
-		return nil
+		return fsc.applyWrite(ctx, w)
 	}
-	return runAsync(ctx, asyncFunc)
+	return fsc.runWrite(ctx, asyncFunc)
 }
 
 func (fsc *FSClient) updateEntities(ctx context.Context, req *Request, sliceVal reflect.Value) FutureFunc {
-	asyncFunc := func() error {
-		slice := sliceVal
-		futures := make([]FutureFunc, slice.Len())
-		var errs []string
-
-		// kick off all updates and collect futures
-		for i := 0; i < slice.Len(); i++ {
-			futures[i] = fsc.updateEntity(ctx, req, slice.Index(i).Interface())
-		}
-
-		// wait for all futures to finish
-		for _, f := range futures {
-			if err := f(); err != nil {
-				errs = append(errs, err.Error())
-			}
-		}
+	toWrite := func(entity interface{}) (write, error) {
+		return fsc.toSetWrite(ctx, req, entity)
+	}
+	if len(req.cascadePaths) > 0 {
+		return fsc.cascadeEntities(ctx, req, sliceVal, toWrite)
+	}
+	return fsc.writeEntities(ctx, req, sliceVal, toWrite)
+}
 
-		// check the errors
-		if len(errs) > 0 {
-			return errors.New(strings.Join(errs, "\n"))
+func (fsc *FSClient) updateFieldsEntity(ctx context.Context, req *Request, entity interface{}, fields []string) FutureFunc {
+	asyncFunc := func() error {
+		w, err := fsc.toUpdateWrite(ctx, req, entity, fields)
+		if err != nil {
+			return err
 		}
-		return nil
+		return fsc.applyWrite(ctx, w)
 	}
-	return runAsync(ctx, asyncFunc)
+	return fsc.runWrite(ctx, asyncFunc)
+}
+
+func (fsc *FSClient) updateFieldsEntities(ctx context.Context, req *Request, sliceVal reflect.Value, fields []string) FutureFunc {
+	return fsc.writeEntities(ctx, req, sliceVal, func(entity interface{}) (write, error) {
+		return fsc.toUpdateWrite(ctx, req, entity, fields)
+	})
 }
 
 func (fsc *FSClient) deleteEntity(ctx context.Context, req *Request, entity interface{}) FutureFunc {
 	asyncFunc := func() error {
-		ref := req.ToRef(entity)
-		if err := del(ctx, ref); err != nil {
+		w, err := fsc.toDeleteWrite(ctx, req, entity)
+		if err != nil {
 			return err
 		}
-		if err := fsc.getCache(ctx).Delete(ctx, ref.Path); err != nil {
-			log.Printf("Cache error but continue: %+v", err)
-		}
-		return nil
+		return fsc.applyWrite(ctx, w)
 	}
-	return runAsync(ctx, asyncFunc)
+	return fsc.runWrite(ctx, asyncFunc)
 }
 
 func (fsc *FSClient) deleteEntities(ctx context.Context, req *Request, sliceVal reflect.Value) FutureFunc {
-	asyncFunc := func() error {
-		slice := sliceVal
-		futures := make([]FutureFunc, slice.Len())
-		var errs []string
-
-		// kick off all updates and collect futures
-		for i := 0; i < slice.Len(); i++ {
-			futures[i] = fsc.deleteEntity(ctx, req, slice.Index(i).Interface())
-		}
-
-		// wait for all futures to finish
-		for _, f := range futures {
-			if err := f(); err != nil {
-				errs = append(errs, err.Error())
-			}
-		}
+	return fsc.writeEntities(ctx, req, sliceVal, func(entity interface{}) (write, error) {
+		return fsc.toDeleteWrite(ctx, req, entity)
+	})
+}
 
-		// check the errors
-		if len(errs) > 0 {
-			return errors.New(strings.Join(errs, "\n"))
+func (fsc *FSClient) restoreEntity(ctx context.Context, req *Request, entity interface{}) FutureFunc {
+	asyncFunc := func() error {
+		w, err := fsc.toRestoreWrite(ctx, req, entity)
+		if err != nil {
+			return err
 		}
-		return nil
+		return fsc.applyWrite(ctx, w)
 	}
-	return runAsync(ctx, asyncFunc)
+	return fsc.runWrite(ctx, asyncFunc)
+}
+
+func (fsc *FSClient) restoreEntities(ctx context.Context, req *Request, sliceVal reflect.Value) FutureFunc {
+	return fsc.writeEntities(ctx, req, sliceVal, func(entity interface{}) (write, error) {
+		return fsc.toRestoreWrite(ctx, req, entity)
+	})
 }
 
 type asyncFunc func() error
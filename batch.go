@@ -0,0 +1,545 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaxBatchSize is the max number of writes firestore allows in a single batch
+const MaxBatchSize = 500
+
+type writeOp int
+
+const (
+	createOp writeOp = iota
+	setOp
+	updateOp
+	deleteOp
+)
+
+func (op writeOp) String() string {
+	return [...]string{"create", "set", "update", "delete"}[op]
+}
+
+// write is a single prepared write of an entity
+type write struct {
+	op      writeOp
+	ref     *firestore.DocumentRef
+	data    map[string]interface{}
+	updates []firestore.Update // the fields to update for updateOp
+	merge   bool               // merge the data into the document for setOp
+	entity  interface{}
+	index   int
+	// lastUpdate is the update time of the document when it was loaded. The write fails if the
+	// document has been modified since. Zero for no precondition
+	lastUpdate time.Time
+	// updateTime is the update time of the document after the write. Zero if not known eg. in transactions
+	updateTime time.Time
+}
+
+func (w write) toError(err error) EntityError {
+	return EntityError{Index: w.index, Entity: w.entity, Ref: w.ref, Err: err}
+}
+
+func (fsc *FSClient) toCreateWrite(ctx context.Context, req *Request, entity interface{}) (write, error) {
+	if err := beforeCreate(ctx, entity); err != nil {
+		return write{}, err
+	}
+	m, err := fsc.toDB(entity)
+	if err != nil {
+		return write{}, err
+	}
+
+	ref := req.ToRef(entity)
+	// if we need a fixed ID use that
+	if req.GetID(entity) == "" {
+		ref = req.ToCollection(entity).NewDoc() // otherwise create new id
+		req.SetID(entity, ref.ID)
+	}
+	req.mapperFunc(m)
+	return write{op: createOp, ref: ref, data: m, entity: entity}, nil
+}
+
+// toSetWrite creates a write replacing the document. With dirty tracking only the fields changed since
+// the entity was loaded in the session are updated. With optimistic locking the write fails if the
+// document has been modified since it was loaded.
+func (fsc *FSClient) toSetWrite(ctx context.Context, req *Request, entity interface{}) (write, error) {
+	if err := beforeUpdate(ctx, entity); err != nil {
+		return write{}, err
+	}
+	m, err := fsc.toDB(entity)
+	if err != nil {
+		return write{}, err
+	}
+	req.mapperFunc(m)
+	if req.merge {
+		removeNils(m) // leave the empty fields untouched
+	}
+	w := write{op: setOp, ref: req.ToRef(entity), data: m, merge: req.merge, entity: entity}
+	if !fsc.DirtyTracking && !fsc.OptimisticLocking {
+		return w, nil
+	}
+	snapshot, updateTime := fsc.getSnapshot(ctx, w.ref)
+	if snapshot == nil {
+		return w, nil
+	}
+	if fsc.DirtyTracking && !req.merge {
+		w = w.toChangesWrite(snapshot)
+	}
+	if fsc.OptimisticLocking {
+		w = w.withPrecondition(snapshot, updateTime)
+	}
+	return w, nil
+}
+
+// toUpdateWrite creates a write updating the fields (dot separated paths) of the entity.
+// The fields of the entity that are not mapped because they are empty are deleted. Unknown fields are an error.
+func (fsc *FSClient) toUpdateWrite(ctx context.Context, req *Request, entity interface{}, fields []string) (write, error) {
+	if err := beforeUpdate(ctx, entity); err != nil {
+		return write{}, err
+	}
+	m, err := fsc.toDB(entity)
+	if err != nil {
+		return write{}, err
+	}
+	req.mapperFunc(m)
+
+	updates := make([]firestore.Update, len(fields))
+	for i, field := range fields {
+		path := strings.Split(field, ".")
+		v, ok := getPath(m, path)
+		if !ok {
+			// the field is not mapped when it is nil or empty
+			if !fsc.hasField(reflect.TypeOf(entity), path) {
+				return write{}, fmt.Errorf("unknown field %s of %T", field, entity)
+			}
+			v = firestore.Delete
+		}
+		updates[i] = firestore.Update{Path: field, Value: v}
+	}
+	w := write{op: updateOp, ref: req.ToRef(entity), updates: updates, entity: entity}
+	if fsc.OptimisticLocking {
+		_, w.lastUpdate = fsc.getSnapshot(ctx, w.ref)
+	}
+	return w, nil
+}
+
+func (fsc *FSClient) toDeleteWrite(ctx context.Context, req *Request, entity interface{}) (write, error) {
+	if err := beforeDelete(ctx, entity); err != nil {
+		return write{}, err
+	}
+	if key, ok := fsc.deletedAtKey(reflect.TypeOf(entity)); ok && !req.hardDelete {
+		return fsc.toSoftDeleteWrite(ctx, req, entity, key)
+	}
+	w := write{op: deleteOp, ref: req.ToRef(entity), entity: entity}
+	if fsc.OptimisticLocking {
+		_, w.lastUpdate = fsc.getSnapshot(ctx, w.ref)
+	}
+	return w, nil
+}
+
+// applyWrite performs a single write and updates the cache
+func (fsc *FSClient) applyWrite(ctx context.Context, w write) error {
+	if w.isNoop() {
+		return nil
+	}
+	if p, ok := ctx.Value(preconditionCtxKey).(*atomic.Bool); ok && w.hasPrecondition() {
+		// the transaction commit fails if the precondition fails
+		p.Store(true)
+	}
+	var res *firestore.WriteResult
+	var err error
+	switch w.op {
+	case createOp:
+		res, err = create(ctx, w.ref, w.data)
+	case setOp:
+		res, err = set(ctx, w.ref, w.data, w.setOptions()...)
+	case updateOp:
+		res, err = update(ctx, w.ref, w.updates, w.preconditions()...)
+	case deleteOp:
+		res, err = del(ctx, w.ref, w.preconditions()...)
+	}
+	if err != nil {
+		return toTypedError(err, w.ref, w.entity, w.hasPrecondition())
+	}
+	if res != nil {
+		w.updateTime = res.UpdateTime
+	}
+	fsc.setWriteTimes(w)
+	fsc.updateCache(ctx, w)
+	return nil
+}
+
+func (w write) setOptions() []firestore.SetOption {
+	if w.merge {
+		return []firestore.SetOption{firestore.MergeAll}
+	}
+	return nil
+}
+
+// hasPrecondition is true if the write fails when the document has been modified or does or does not exist
+func (w write) hasPrecondition() bool {
+	return !w.lastUpdate.IsZero() || w.op == createOp || w.op == updateOp
+}
+
+func hasPrecondition(writes []write) bool {
+	for _, w := range writes {
+		if w.hasPrecondition() {
+			return true
+		}
+	}
+	return false
+}
+
+func (w write) preconditions() []firestore.Precondition {
+	if w.lastUpdate.IsZero() {
+		return nil
+	}
+	return []firestore.Precondition{firestore.LastUpdateTime(w.lastUpdate)}
+}
+
+func (fsc *FSClient) updateCache(ctx context.Context, writes ...write) {
+	fsc.warnNoSessionCache(ctx)
+	sets := make(map[string]EntityMap, len(writes))
+	var deletes []string
+	paths := make([]string, len(writes))
+	for i, w := range writes {
+		paths[i] = w.ref.Path
+		switch {
+		case w.op == deleteOp:
+			deletes = append(deletes, w.ref.Path)
+		case w.op == updateOp || w.merge:
+			// partial writes are patched into the cached entity
+			if err := fsc.getCache(ctx).Patch(ctx, w.ref, w.patch); err != nil {
+				fsc.log(ctx, LevelError, "Cache error but continue", "op", w.op.String(), "path", w.ref.Path, "err", err)
+			}
+		default:
+			sets[w.ref.Path] = withMetadata(w.data, w.metadata())
+		}
+	}
+	fsc.keepCreateTimes(ctx, writes, sets)
+	if err := fsc.getCache(ctx).WriteMulti(ctx, sets); err != nil {
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "write", "paths", mapKeys(sets), "err", err)
+	}
+	if err := fsc.getCache(ctx).DeleteMulti(ctx, deletes); err != nil {
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "delete", "paths", deletes, "err", err)
+	}
+	fsc.invalidate(ctx, paths)
+}
+
+// keepCreateTimes carries the create times of the cached entities over to the entities replaced by sets as the
+// create time is only returned by reads. Sets of entities without a known create time are evicted instead so they are
+// reloaded with it
+func (fsc *FSClient) keepCreateTimes(ctx context.Context, writes []write, sets map[string]EntityMap) {
+	if fsc.CreateTimeKey == "" {
+		return
+	}
+	var keys []string
+	for _, w := range writes {
+		if w.op == setOp && !w.merge {
+			keys = append(keys, w.ref.Path)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	createTimes, err := fsc.getCache(ctx).createTimes(ctx, keys)
+	if err != nil {
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "createTimes", "paths", keys, "err", err)
+	}
+	var evict []string
+	for _, key := range keys {
+		if t, ok := createTimes[key]; ok {
+			setTime(sets[key], createTimeKey, t)
+		} else {
+			delete(sets, key)
+			evict = append(evict, key)
+		}
+	}
+	if err := fsc.getCache(ctx).EvictMulti(ctx, evict); err != nil {
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "evict", "paths", evict, "err", err)
+	}
+}
+
+// writeEntities prepares a write for each entity in the slice and commits them in batches of MaxBatchSize.
+// Inside a transaction the writes are added to the transaction instead.
+func (fsc *FSClient) writeEntities(ctx context.Context, req *Request, sliceVal reflect.Value, toWrite func(entity interface{}) (write, error)) FutureFunc {
+	asyncFunc := func() error {
+		slice := sliceVal
+		writes := make([]write, 0, slice.Len())
+		var errs []EntityError
+
+		for i := 0; i < slice.Len(); i++ {
+			entity := slice.Index(i).Interface()
+			w, err := toWrite(entity)
+			if err != nil {
+				errs = append(errs, EntityError{Index: i, Entity: entity, Err: err})
+				continue
+			}
+			if w.isNoop() {
+				continue
+			}
+			w.index = i
+			writes = append(writes, w)
+		}
+		return fsc.applyWrites(ctx, req, writes, errs)
+	}
+	return runAsync(ctx, asyncFunc)
+}
+
+// applyWrites commits the writes and returns a MultiError with the errors of the writes that failed
+// along with the errors already found
+func (fsc *FSClient) applyWrites(ctx context.Context, req *Request, writes []write, errs []EntityError) error {
+	if req.atomic && len(errs) > 0 {
+		return multiErrorOrNil(errs)
+	}
+
+	if _, ok := getTransaction(ctx); ok {
+		// the transaction is committed as a whole
+		for _, w := range writes {
+			if err := fsc.applyWrite(ctx, w); err != nil {
+				errs = append(errs, w.toError(err))
+			}
+		}
+	} else {
+		if req.atomic && len(writes) > MaxBatchSize {
+			return fmt.Errorf("atomic writes are limited to %d entities but got %d", MaxBatchSize, len(writes))
+		}
+		errs = append(errs, fsc.commitWrites(ctx, writes, req.atomic)...)
+	}
+	return multiErrorOrNil(errs)
+}
+
+// commitWrites commits the writes in batches and returns the errors of the writes that failed. If a batch fails
+// and the writes are not atomic its writes are retried one at a time so only the writes that fail are reported.
+// See retryWrites
+func (fsc *FSClient) commitWrites(ctx context.Context, writes []write, atomic bool) []EntityError {
+	// kick off all batches and collect futures
+	batches := toBatches(writes)
+	futures := make([]FutureFunc, len(batches))
+	batchErrs := make([][]EntityError, len(batches))
+	for i, batch := range batches {
+		i, batch := i, batch
+		futures[i] = fsc.runWrite(ctx, func() error {
+			res, err := commit(ctx, fsc.Client, batch)
+			if err != nil && !atomic && len(batch) > 1 {
+				// firestore does not tell which write failed the batch
+				batchErrs[i] = fsc.retryWrites(ctx, batch, err)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for j := range batch {
+				batch[j].updateTime = res[j].UpdateTime
+				fsc.setWriteTimes(batch[j])
+			}
+			fsc.updateCache(ctx, batch...)
+			return nil
+		})
+	}
+
+	// wait for all futures to finish. Every write in a failed atomic batch has failed
+	var errs []EntityError
+	for i, f := range futures {
+		if err := f(); err != nil {
+			for _, w := range batches[i] {
+				if len(batches[i]) == 1 {
+					errs = append(errs, w.toError(toTypedError(err, w.ref, w.entity, w.hasPrecondition())))
+				} else {
+					errs = append(errs, w.toError(toTypedError(err, nil, nil, hasPrecondition(batches[i]))))
+				}
+			}
+		}
+		errs = append(errs, batchErrs[i]...)
+	}
+	return errs
+}
+
+// retryWrites applies the writes of the failed batch one at a time and returns the errors of the writes that fail.
+// After an ambiguous error the batch may have been committed anyway. Then a create of a document that exists with
+// the same data succeeds and a write with a precondition on the update time is not retried as it would conflict with
+// itself. It fails with the error of the batch instead
+func (fsc *FSClient) retryWrites(ctx context.Context, batch []write, batchErr error) []EntityError {
+	ambiguous := isAmbiguousError(batchErr)
+	var errs []EntityError
+	for _, w := range batch {
+		if ambiguous && !w.lastUpdate.IsZero() {
+			errs = append(errs, w.toError(batchErr))
+			continue
+		}
+		err := fsc.applyWrite(ctx, w)
+		if _, exists := err.(AlreadyExistsError); exists && ambiguous {
+			err = fsc.confirmCreate(ctx, w, err)
+		}
+		if err != nil {
+			errs = append(errs, w.toError(err))
+		}
+	}
+	return errs
+}
+
+// confirmCreate checks if the document of the create holds the data of the write. Then it was created by the
+// batch and the write succeeded. Otherwise the error of the create is returned
+func (fsc *FSClient) confirmCreate(ctx context.Context, w write, err error) error {
+	doc, getErr := w.ref.Get(ctx)
+	if getErr != nil || !reflect.DeepEqual(normalizeValue(w.data), normalizeValue(doc.Data())) {
+		return err
+	}
+	w.updateTime = doc.UpdateTime
+	fsc.setWriteTimes(w)
+	fsc.updateCache(ctx, w)
+	return nil
+}
+
+// normalizeValue converts the value to the types firestore returns when it is read so written and read data can be
+// compared
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case *firestore.DocumentRef:
+		if x == nil {
+			return nil
+		}
+		return x.Path
+	case time.Time:
+		return x.Truncate(time.Microsecond).UnixMicro() // firestore stores microseconds
+	case *latlng.LatLng:
+		if x == nil {
+			return nil
+		}
+		return [2]float64{x.Latitude, x.Longitude}
+	case []byte:
+		return x
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return normalizeValue(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		result := make([]interface{}, rv.Len())
+		for i := range result {
+			result[i] = normalizeValue(rv.Index(i).Interface())
+		}
+		return result
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		result := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			result[fmt.Sprint(iter.Key().Interface())] = normalizeValue(iter.Value().Interface())
+		}
+		return result
+	}
+	return v
+}
+
+// patch applies the write to the entity map
+func (w write) patch(m EntityMap) {
+	md := w.metadata()
+	if md.createTime.IsZero() {
+		// the create time is only known from reads so keep the cached one
+		md.createTime, _ = m[createTimeKey].(time.Time)
+	}
+	switch {
+	case w.op == updateOp:
+		for _, u := range w.updates {
+			path := []string(u.FieldPath)
+			if path == nil {
+				path = strings.Split(u.Path, ".")
+			}
+			setPath(m, path, u.Value)
+		}
+	case w.merge:
+		mergeMaps(m, w.data)
+	default:
+		for k := range m {
+			delete(m, k)
+		}
+		for k, v := range w.data {
+			m[k] = v
+		}
+	}
+	withMetadata(m, md)
+}
+
+// metadata returns the metadata of the document after the write. The times are zero if the write result is not known
+func (w write) metadata() metadata {
+	switch w.op {
+	case deleteOp:
+		return metadata{}
+	case createOp:
+		return metadata{w.updateTime, w.updateTime, w.updateTime}
+	}
+	return metadata{updateTime: w.updateTime, readTime: w.updateTime}
+}
+
+// setWriteTimes sets the create and update times returned by the write on the entity
+func (fsc *FSClient) setWriteTimes(w write) {
+	md := w.metadata()
+	md.readTime = time.Time{}
+	fsc.setMetadataFields(w.entity, md)
+}
+
+// removeNils removes the nil values (including nil slices and maps) from the map and its nested maps
+func removeNils(m map[string]interface{}) {
+	for k, v := range m {
+		if nested, ok := v.(map[string]interface{}); ok {
+			removeNils(nested)
+			continue
+		}
+		val := reflect.ValueOf(v)
+		switch val.Kind() {
+		case reflect.Invalid:
+			delete(m, k)
+		case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface:
+			if val.IsNil() {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+func getPath(m map[string]interface{}, path []string) (interface{}, bool) {
+	v, ok := m[path[0]]
+	if !ok || len(path) == 1 {
+		return v, ok
+	}
+	if nested, isMap := v.(map[string]interface{}); isMap {
+		return getPath(nested, path[1:])
+	}
+	return nil, false
+}
+
+func toBatches(writes []write) [][]write {
+	var batches [][]write
+	for len(writes) > MaxBatchSize {
+		batches = append(batches, writes[:MaxBatchSize])
+		writes = writes[MaxBatchSize:]
+	}
+	if len(writes) > 0 {
+		batches = append(batches, writes)
+	}
+	return batches
+}
@@ -0,0 +1,108 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type updateEngine struct {
+	Power int
+}
+
+type updateCar struct {
+	ID     string
+	Make   string
+	Model  string `firestorm:"name"`
+	Engine *updateEngine
+	Extras map[string]interface{}
+	Temp   string `firestorm:"-"`
+}
+
+func TestToUpdateWrite(t *testing.T) {
+	// the writes are only prepared so the emulator does not need to run
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	client, err := firestore.NewClient(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fsc := New(client, "ID", "")
+	ctx := context.Background()
+	car := &updateCar{ID: "1", Make: "Toyota"}
+
+	w, err := fsc.toUpdateWrite(ctx, fsc.NewRequest(), car, []string{"make", "name", "engine", "engine.power", "extras.color"})
+	if err != nil {
+		t.Fatalf("the fields should have been updated: %v", err)
+	}
+	if w.updates[0].Value != "Toyota" || w.updates[1].Value != "" {
+		t.Errorf("the fields should have the values of the entity: %v", w.updates)
+	}
+	for _, u := range w.updates[2:] {
+		if u.Value != firestore.Delete {
+			t.Errorf("the empty field %s should have been deleted: %v", u.Path, u.Value)
+		}
+	}
+
+	for _, field := range []string{"maker", "model", "temp", "engine.torque", "make.name"} {
+		if _, err := fsc.toUpdateWrite(ctx, fsc.NewRequest(), car, []string{field}); err == nil {
+			t.Errorf("the unknown field %s should fail the update", field)
+		}
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	client, err := firestore.NewClient(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	now := time.Now()
+
+	// the data as it is written and as firestore returns it when it is read
+	written := map[string]interface{}{
+		"year":     2001,
+		"price":    float32(1.5),
+		"created":  now,
+		"owner":    client.Doc("Person/1"),
+		"location": &latlng.LatLng{Latitude: 55.7, Longitude: 12.6},
+		"tags":     []string{"a", "b"},
+		"driver":   map[string]interface{}{"age": int32(30)},
+	}
+	read := map[string]interface{}{
+		"year":     int64(2001),
+		"price":    1.5,
+		"created":  now.Truncate(time.Microsecond).UTC(),
+		"owner":    client.Doc("Person/1"),
+		"location": &latlng.LatLng{Latitude: 55.7, Longitude: 12.6},
+		"tags":     []interface{}{"a", "b"},
+		"driver":   map[string]interface{}{"age": int64(30)},
+	}
+	if !reflect.DeepEqual(normalizeValue(written), normalizeValue(read)) {
+		t.Errorf("the written and read data should be equal: %v %v", normalizeValue(written), normalizeValue(read))
+	}
+	read["year"] = int64(2002)
+	if reflect.DeepEqual(normalizeValue(written), normalizeValue(read)) {
+		t.Errorf("the written and read data should differ")
+	}
+}
+
+func TestIsAmbiguousError(t *testing.T) {
+	for _, err := range []error{context.DeadlineExceeded, status.Error(codes.Unavailable, ""), errors.New("connection reset")} {
+		if !isAmbiguousError(err) {
+			t.Errorf("the error should be ambiguous: %v", err)
+		}
+	}
+	for _, err := range []error{status.Error(codes.AlreadyExists, ""), status.Error(codes.FailedPrecondition, "")} {
+		if isAmbiguousError(err) {
+			t.Errorf("the error should be a definitive rejection: %v", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package firestorm
+
+import (
+	"context"
+	"fmt"
+	"github.com/jschoedt/go-firestorm/codec"
+)
+
+// ByteCache can be used to implement a second level cache storing the entities as bytes eg. memcache.
+// The entities are encoded by the codec given to SetByteCache so the firestore types survive the round trip.
+// Get returns ErrCacheMiss if the key is not found.
+type ByteCache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+	Set(ctx context.Context, key string, item []byte) error
+	SetMulti(ctx context.Context, items map[string][]byte) error
+	Delete(ctx context.Context, key string) error
+	DeleteMulti(ctx context.Context, keys []string) error
+}
+
+// SetByteCache sets a second level cache besides the session cache that stores the entities encoded by the codec.
+// See the codec package for the available codecs
+func (fsc *FSClient) SetByteCache(cache ByteCache, c codec.Codec) {
+	fsc.SetCache(&codecCache{cache: cache, codec: c})
+}
+
+// codecCache is a Cache encoding the entities stored in a ByteCache
+type codecCache struct {
+	cache ByteCache
+	codec codec.Codec
+}
+
+func (c *codecCache) Get(ctx context.Context, key string) (EntityMap, error) {
+	data, err := c.cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return c.codec.Unmarshal(data)
+}
+
+func (c *codecCache) GetMulti(ctx context.Context, keys []string) (map[string]EntityMap, error) {
+	multi, err := c.cache.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]EntityMap, len(multi))
+	for key, data := range multi {
+		m, err := c.codec.Unmarshal(data)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = m
+	}
+	return result, nil
+}
+
+func (c *codecCache) Set(ctx context.Context, key string, item EntityMap) error {
+	data, err := c.codec.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(ctx, key, data)
+}
+
+// SetMulti encodes and sets the entities. An entity that cannot be encoded is skipped and its error is returned
+// after the other entities are set
+func (c *codecCache) SetMulti(ctx context.Context, items map[string]EntityMap) error {
+	multi := make(map[string][]byte, len(items))
+	var encodeErr error
+	for key, item := range items {
+		data, err := c.codec.Marshal(item)
+		if err != nil {
+			encodeErr = fmt.Errorf("%s: %w", key, err)
+			continue
+		}
+		multi[key] = data
+	}
+	if len(multi) > 0 {
+		if err := c.cache.SetMulti(ctx, multi); err != nil {
+			return err
+		}
+	}
+	return encodeErr
+}
+
+func (c *codecCache) Delete(ctx context.Context, key string) error {
+	return c.cache.Delete(ctx, key)
+}
+
+func (c *codecCache) DeleteMulti(ctx context.Context, keys []string) error {
+	return c.cache.DeleteMulti(ctx, keys)
+}
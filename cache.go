@@ -3,11 +3,11 @@ package firestorm
 import (
 	"context"
 	"errors"
-	"log"
 	"net/http"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/firestore"
 )
@@ -17,7 +17,6 @@ var (
 	SessionCacheKey = contextKey("sessionCache")
 	// ErrCacheMiss returned on a cache miss
 	ErrCacheMiss = errors.New("not found in cache")
-	logOnce      sync.Once
 )
 
 const cacheElement = "_cacheElement"
@@ -50,9 +49,13 @@ type Cache interface {
 }
 
 type cacheWrapper struct {
-	client *firestore.Client
-	first  Cache
-	second Cache
+	client   *firestore.Client
+	first    Cache
+	second   Cache
+	policies *cachePolicies
+	bus      InvalidationBus
+	source   string // identifies the client on the bus
+	stats    *cacheStats
 }
 
 func newCacheWrapper(client *firestore.Client, first Cache, second Cache) *cacheWrapper {
@@ -60,6 +63,8 @@ func newCacheWrapper(client *firestore.Client, first Cache, second Cache) *cache
 	cw.client = client
 	cw.first = first
 	cw.second = second
+	cw.policies = newCachePolicies()
+	cw.stats = newCacheStats()
 	return cw
 }
 
@@ -69,9 +74,16 @@ func (c *cacheWrapper) convertToCacheRef(m EntityMap, ref *firestore.DocumentRef
 }
 
 func (c *cacheWrapper) Get(ctx context.Context, ref *firestore.DocumentRef) (cacheRef, error) {
+	keys := []string{ref.Path}
+	found := func(key string) bool { return true }
+	start := time.Now()
 	m, err := c.first.Get(ctx, ref.Path)
-	if err == ErrCacheMiss && c.second != nil {
+	c.stats.lookup(sessionLevel, start, keys, found, err)
+	if err == ErrCacheMiss && c.second != nil && !c.policies.get(ref.Path).NoCache {
+		start = time.Now()
 		m, err = c.second.Get(ctx, ref.Path)
+		c.stats.lookup(secondLevel, start, keys, found, err)
+		m = fromSecond(m)
 	}
 
 	//log.Printf("Get: ID: %v - %+v\n", ref.Path, m)
@@ -88,7 +100,12 @@ func (c *cacheWrapper) GetMulti(ctx context.Context, refs []*firestore.DocumentR
 		keyToRef[ref.Path] = ref
 	}
 
+	start := time.Now()
 	first, err := c.first.GetMulti(ctx, keys)
+	c.stats.lookup(sessionLevel, start, keys, func(key string) bool {
+		_, ok := first[key]
+		return ok
+	}, err)
 	if err != nil {
 		return nil, err
 	}
@@ -112,13 +129,29 @@ func (c *cacheWrapper) GetMulti(ctx context.Context, refs []*firestore.DocumentR
 		}
 	}
 	// get the diff list
-	if second, err := c.second.GetMulti(ctx, remaining); err != nil {
+	cached := c.policies.cached(remaining)
+	if len(cached) == 0 {
+		return result, nil
+	}
+	start = time.Now()
+	second, err := c.second.GetMulti(ctx, cached)
+	c.stats.lookup(secondLevel, start, cached, func(key string) bool {
+		_, ok := second[key]
+		return ok
+	}, err)
+	if err != nil {
+		return nil, err
+	}
+	promote := make(map[string]EntityMap, len(second))
+	for key, elm := range second {
+		ref := keyToRef[key]
+		elm = fromSecond(elm)
+		promote[key] = elm.Copy()
+		result[ref] = c.convertToCacheRef(elm, ref) // update result with first level
+	}
+	// keep the second level hits in the session so they are tracked as well
+	if err := c.first.SetMulti(ctx, promote); err != nil {
 		return nil, err
-	} else {
-		for key, elm := range second {
-			ref := keyToRef[key]
-			result[ref] = c.convertToCacheRef(elm, ref) // update result with first level
-		}
 	}
 
 	return result, nil
@@ -127,16 +160,27 @@ func (c *cacheWrapper) GetMulti(ctx context.Context, refs []*firestore.DocumentR
 func (c *cacheWrapper) Set(ctx context.Context, key string, item map[string]interface{}) error {
 	//log.Printf("Set: ID: %v - %+v\n", key, item)
 	c.makeCachable(item)
-	if err := c.first.Set(ctx, key, item); err != nil {
+	start := time.Now()
+	err := c.first.Set(ctx, key, item)
+	c.stats.observe(sessionLevel, start, err)
+	if err != nil {
 		return err
 	}
-	if c.second != nil {
-		return c.second.Set(ctx, key, item)
-	}
-	return nil
+	return c.setSecond(ctx, map[string]EntityMap{key: item}, false)
 }
 
+// SetMulti caches the loaded entities
 func (c *cacheWrapper) SetMulti(ctx context.Context, items map[string]EntityMap) error {
+	return c.setMulti(ctx, items, false)
+}
+
+// WriteMulti caches the written entities. They are removed from the second level cache instead if the cache policy
+// invalidates on writes
+func (c *cacheWrapper) WriteMulti(ctx context.Context, items map[string]EntityMap) error {
+	return c.setMulti(ctx, items, true)
+}
+
+func (c *cacheWrapper) setMulti(ctx context.Context, items map[string]EntityMap, written bool) error {
 	if len(items) == 0 {
 		return nil
 	}
@@ -146,38 +190,158 @@ func (c *cacheWrapper) SetMulti(ctx context.Context, items map[string]EntityMap)
 		c.makeCachable(v)
 		cache[k] = v
 	}
-	if err := c.first.SetMulti(ctx, cache); err != nil {
+	start := time.Now()
+	err := c.first.SetMulti(ctx, cache)
+	c.stats.observe(sessionLevel, start, err)
+	if err != nil {
 		return err
 	}
-	if c.second != nil {
-		return c.second.SetMulti(ctx, cache)
-	}
-	return nil
+	return c.setSecond(ctx, cache, written)
 }
 
 func (c *cacheWrapper) Delete(ctx context.Context, key string) error {
-	if err := c.first.Delete(ctx, key); err != nil {
+	start := time.Now()
+	err := c.first.Delete(ctx, key)
+	c.stats.observe(sessionLevel, start, err)
+	if err != nil {
 		return err
 	}
 	if c.second != nil {
-		return c.second.Delete(ctx, key)
+		start = time.Now()
+		err = c.second.Delete(ctx, key)
+		c.stats.observe(secondLevel, start, err)
 	}
-	return nil
+	return err
 }
 
 func (c *cacheWrapper) DeleteMulti(ctx context.Context, keys []string) error {
 	if len(keys) == 0 {
 		return nil
 	}
-	if err := c.first.DeleteMulti(ctx, keys); err != nil {
+	start := time.Now()
+	err := c.first.DeleteMulti(ctx, keys)
+	c.stats.observe(sessionLevel, start, err)
+	if err != nil {
 		return err
 	}
-	if c.second != nil {
-		return c.second.DeleteMulti(ctx, keys)
+	return c.deleteSecondMulti(ctx, keys)
+}
+
+// setFirstMulti sets the items in the session cache only
+func (c *cacheWrapper) setFirstMulti(ctx context.Context, items map[string]EntityMap) error {
+	if len(items) == 0 {
+		return nil
 	}
-	return nil
+	for _, v := range items {
+		c.makeCachable(v)
+	}
+	start := time.Now()
+	err := c.first.SetMulti(ctx, items)
+	c.stats.observe(sessionLevel, start, err)
+	return err
 }
 
+// setSecondMulti sets the items in the second level cache only
+func (c *cacheWrapper) setSecondMulti(ctx context.Context, items map[string]EntityMap) error {
+	for _, v := range items {
+		c.makeCachable(v)
+	}
+	return c.setSecond(ctx, items, false)
+}
+
+// deleteSecondMulti deletes the keys from the second level cache only
+func (c *cacheWrapper) deleteSecondMulti(ctx context.Context, keys []string) error {
+	if c.second == nil || len(keys) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := c.second.DeleteMulti(ctx, keys)
+	c.stats.observe(secondLevel, start, err)
+	return err
+}
+
+// Patch applies the partial update to the entity in the session cache and evicts it from the second level cache.
+// The merged entity is not written to the second level as another client may patch the same entity concurrently.
+// If the entity is not in the session it is evicted from all cache levels so it will be reloaded from firestore
+func (c *cacheWrapper) Patch(ctx context.Context, ref *firestore.DocumentRef, patch func(m EntityMap)) error {
+	m, err := c.first.Get(ctx, ref.Path)
+	if err != nil && err != ErrCacheMiss {
+		return err
+	}
+	if len(m) == 0 {
+		return c.EvictMulti(ctx, []string{ref.Path})
+	}
+	m = m.Copy()
+	c.makeUnCachable(m)
+	patch(m)
+	if e, ok := c.first.(*defaultCache); ok {
+		e.recordPatched(ref.Path)
+	}
+	if err := c.setFirstMulti(ctx, map[string]EntityMap{ref.Path: m}); err != nil {
+		return err
+	}
+	return c.deleteSecondMulti(ctx, []string{ref.Path})
+}
+
+// snapshot returns the entity as it was last loaded or written in the session and the update time
+// of the document if it is known. The entity is nil if it is not in the session.
+func (c *cacheWrapper) snapshot(ctx context.Context, ref *firestore.DocumentRef) (EntityMap, time.Time) {
+	m, err := c.first.Get(ctx, ref.Path)
+	if err != nil || len(m) == 0 {
+		return nil, time.Time{}
+	}
+	m = m.Copy()
+	c.makeUnCachable(m)
+	return m, popMetadata(m).updateTime
+}
+
+// createTimes returns the create times of the entities cached in the session or the second level cache.
+// Entities that are not cached or cached without a create time are left out
+func (c *cacheWrapper) createTimes(ctx context.Context, keys []string) (map[string]time.Time, error) {
+	result := make(map[string]time.Time, len(keys))
+	first, err := c.first.GetMulti(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	var remaining []string
+	for _, key := range keys {
+		if t, ok := first[key][createTimeKey].(time.Time); ok {
+			result[key] = t
+		} else if _, ok := first[key]; !ok {
+			remaining = append(remaining, key)
+		}
+	}
+	cached := c.policies.cached(remaining)
+	if c.second == nil || len(cached) == 0 {
+		return result, nil
+	}
+	second, err := c.second.GetMulti(ctx, cached)
+	if err != nil {
+		return nil, err
+	}
+	for key, m := range second {
+		if t, ok := fromSecond(m)[createTimeKey].(time.Time); ok {
+			result[key] = t
+		}
+	}
+	return result, nil
+}
+
+// EvictMulti removes the keys from the caches. Unlike DeleteMulti which caches that the entities are deleted
+func (c *cacheWrapper) EvictMulti(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if e, ok := c.first.(*defaultCache); ok {
+		e.evictMulti(ctx, keys)
+	} else if err := c.first.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+	return c.deleteSecondMulti(ctx, keys)
+}
+
+// makeCachable replaces the refs of the entity with their paths. The refs in nested maps and slices of maps are
+// replaced in copies so the maps shared with the entity are not modified
 func (c *cacheWrapper) makeCachable(m map[string]interface{}) {
 	const sep = "/documents/" // for some reason Firestore cant use the full path so cut it
 	for k, v := range m {
@@ -185,6 +349,8 @@ func (c *cacheWrapper) makeCachable(m map[string]interface{}) {
 		case *firestore.DocumentRef:
 			m[k+cacheElement] = strings.Split(val.Path, sep)[1]
 			delete(m, k)
+		case map[string]interface{}:
+			m[k] = copyNested(val, c.makeCachable)
 		default:
 			valOf := reflect.ValueOf(v)
 			switch valOf.Kind() {
@@ -200,6 +366,8 @@ func (c *cacheWrapper) makeCachable(m map[string]interface{}) {
 						}
 						m[k+cacheSlice] = refs
 						delete(m, k)
+					} else {
+						m[k] = copyNestedSlice(valOf, c.makeCachable)
 					}
 				}
 			}
@@ -214,24 +382,92 @@ func (c *cacheWrapper) makeUnCachable(m map[string]interface{}) {
 			delete(m, k)
 		} else if strings.HasSuffix(k, cacheSlice) {
 			// interface type to be consistent with firestorm arrays
-			res := make([]interface{}, len(v.([]string)))
-			for i, v := range v.([]string) {
+			paths := cachedPaths(v)
+			res := make([]interface{}, len(paths))
+			for i, v := range paths {
 				res[i] = c.client.Doc(v)
 			}
 			m[strings.Replace(k, cacheSlice, "", -1)] = res
 			delete(m, k)
+		} else if nested, ok := v.(map[string]interface{}); ok {
+			m[k] = copyNested(nested, c.makeUnCachable)
+		} else if valOf := reflect.ValueOf(v); valOf.Kind() == reflect.Slice && valOf.Len() > 0 {
+			m[k] = copyNestedSlice(valOf, c.makeUnCachable)
 		}
 	}
 }
 
+// copyNested applies f to a copy of the nested map
+func copyNested(m map[string]interface{}, f func(m map[string]interface{})) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	f(result)
+	return result
+}
+
+// copyNestedSlice applies f to copies of the maps in the slice. The slice is returned as is if it has no maps
+func copyNestedSlice(s reflect.Value, f func(m map[string]interface{})) interface{} {
+	if k := s.Type().Elem().Kind(); k != reflect.Interface && k != reflect.Map {
+		return s.Interface()
+	}
+	var result reflect.Value
+	for i := 0; i < s.Len(); i++ {
+		nested, ok := s.Index(i).Interface().(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if !result.IsValid() {
+			result = reflect.MakeSlice(s.Type(), s.Len(), s.Len())
+			reflect.Copy(result, s)
+		}
+		result.Index(i).Set(reflect.ValueOf(copyNested(nested, f)))
+	}
+	if !result.IsValid() {
+		return s.Interface()
+	}
+	return result.Interface()
+}
+
+// cachedPaths returns the paths of a cached ref slice. The paths are decoded as []interface{} when the entity has been
+// serialized by a codec
+func cachedPaths(v interface{}) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		paths := make([]string, 0, len(v))
+		for _, p := range v {
+			if s, ok := p.(string); ok {
+				paths = append(paths, s)
+			}
+		}
+		return paths
+	}
+	return nil
+}
+
 type defaultCache struct {
 	sync.RWMutex
+	evicted map[string]bool // evicted keys. Only tracked in transactions
+	written map[string]bool // written keys. Only tracked in transactions
+	patched map[string]bool // partially updated keys. Only tracked in transactions
 }
 
 func newDefaultCache() *defaultCache {
 	return &defaultCache{}
 }
 
+// newTransactionCache creates a cache that also records the evicted keys so they can be evicted
+// from the global cache when the transaction is committed
+func newTransactionCache() *defaultCache {
+	return &defaultCache{evicted: make(map[string]bool), written: make(map[string]bool), patched: make(map[string]bool)}
+}
+
 func (c *defaultCache) Get(ctx context.Context, key string) (EntityMap, error) {
 	c.RLock()
 	defer c.RUnlock()
@@ -282,32 +518,150 @@ func (c *defaultCache) DeleteMulti(ctx context.Context, keys []string) error {
 	return nil
 }
 
+func (c *defaultCache) evictMulti(ctx context.Context, keys []string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range keys {
+		delete(getSessionCache(ctx), key)
+		if c.evicted != nil {
+			c.evicted[key] = true
+		}
+	}
+}
+
+func (c *defaultCache) getEvictRec() []string {
+	c.RLock()
+	defer c.RUnlock()
+	result := make([]string, 0, len(c.evicted))
+	for key := range c.evicted {
+		result = append(result, key)
+	}
+	return result
+}
+
+func (c *defaultCache) recordWritten(keys []string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range keys {
+		c.written[key] = true
+	}
+}
+
+func (c *defaultCache) getWrittenRec() []string {
+	c.RLock()
+	defer c.RUnlock()
+	result := make([]string, 0, len(c.written))
+	for key := range c.written {
+		result = append(result, key)
+	}
+	return result
+}
+
+func (c *defaultCache) recordPatched(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.patched != nil {
+		c.patched[key] = true
+	}
+}
+
+// getSetRec returns the written entities
 func (c *defaultCache) getSetRec(ctx context.Context) map[string]EntityMap {
+	c.RLock()
+	defer c.RUnlock()
+	result := make(map[string]EntityMap)
+	for key, elm := range getSessionCache(ctx) {
+		if elm != nil && c.written[key] && !c.patched[key] {
+			result[key] = elm
+		}
+	}
+	return result
+}
+
+// getReadRec returns the entities that were only read
+func (c *defaultCache) getReadRec(ctx context.Context) map[string]EntityMap {
+	c.RLock()
+	defer c.RUnlock()
+	result := make(map[string]EntityMap)
+	for key, elm := range getSessionCache(ctx) {
+		if elm != nil && !c.written[key] {
+			result[key] = elm
+		}
+	}
+	return result
+}
+
+// getPatchRec returns the partially updated entities that are only kept in the session cache
+func (c *defaultCache) getPatchRec(ctx context.Context) map[string]EntityMap {
+	c.RLock()
+	defer c.RUnlock()
 	result := make(map[string]EntityMap)
 	for key, elm := range getSessionCache(ctx) {
-		if elm != nil {
+		if elm != nil && c.patched[key] {
 			result[key] = elm
 		}
 	}
 	return result
 }
 
+// getDeleteRec returns the keys of the deleted entities
 func (c *defaultCache) getDeleteRec(ctx context.Context) []string {
+	c.RLock()
+	defer c.RUnlock()
 	var result []string
 	for key, elm := range getSessionCache(ctx) {
-		if elm == nil {
+		if elm == nil && c.written[key] {
 			result = append(result, key)
 		}
 	}
 	return result
 }
 
+// setPath sets the value at the dot separated path in the map. The nested maps on the path are copied
+// so maps shared with other entities are not modified. The firestore.Delete value deletes the field.
+func setPath(m map[string]interface{}, path []string, v interface{}) {
+	if len(path) == 1 {
+		if v == firestore.Delete {
+			delete(m, path[0])
+		} else {
+			m[path[0]] = v
+		}
+		return
+	}
+	child := make(map[string]interface{})
+	if nested, ok := m[path[0]].(map[string]interface{}); ok {
+		for k, v := range nested {
+			child[k] = v
+		}
+	} else if v == firestore.Delete {
+		return
+	}
+	m[path[0]] = child
+	setPath(child, path[1:], v)
+}
+
+// mergeMaps merges src into dst the same way as firestore.MergeAll so nested maps are merged recursively.
+// The nested maps of dst are copied before they are modified.
+func mergeMaps(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcChild, ok := v.(map[string]interface{})
+		dstChild, dstOk := dst[k].(map[string]interface{})
+		if !ok || !dstOk {
+			dst[k] = v
+			continue
+		}
+		child := make(map[string]interface{}, len(dstChild))
+		for ck, cv := range dstChild {
+			child[ck] = cv
+		}
+		mergeMaps(child, srcChild)
+		dst[k] = child
+	}
+}
+
 func getSessionCache(ctx context.Context) map[string]EntityMap {
 	if c, ok := ctx.Value(SessionCacheKey).(map[string]EntityMap); ok {
 		return c
 	}
-	logOnce.Do(func() {
-		log.Println("Warning. Consider adding the CacheHandler middleware for the session cache to work")
-	})
 	return make(map[string]EntityMap)
 }
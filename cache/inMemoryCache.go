@@ -49,6 +49,14 @@ func (m *InMemoryCache) SetMulti(ctx context.Context, items map[string]firestorm
 	return nil
 }
 
+// SetMultiWithTTL sets the entities with the given expiration. Implements firestorm.TTLCache
+func (m *InMemoryCache) SetMultiWithTTL(ctx context.Context, items map[string]firestorm.EntityMap, ttl time.Duration) error {
+	for i, elm := range items {
+		m.c.Set(i, elm, ttl)
+	}
+	return nil
+}
+
 func (m *InMemoryCache) Delete(ctx context.Context, key string) error {
 	m.c.Delete(key)
 	return nil
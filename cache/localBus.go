@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"context"
+	"github.com/jschoedt/go-firestorm"
+	"sync"
+)
+
+// LocalBus is a firestorm.InvalidationBus delivering the invalidations in process. Use it to share invalidations
+// between several clients in the same process eg. in tests
+type LocalBus struct {
+	mu       sync.RWMutex
+	handlers map[int]func(inv firestorm.Invalidation)
+	next     int
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{handlers: make(map[int]func(inv firestorm.Invalidation))}
+}
+
+// Publish calls the handlers of the subscribers before returning
+func (b *LocalBus) Publish(ctx context.Context, inv firestorm.Invalidation) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(inv)
+	}
+	return nil
+}
+
+func (b *LocalBus) Subscribe(ctx context.Context, handler func(inv firestorm.Invalidation)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.handlers[id] = handler
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}()
+	return nil
+}
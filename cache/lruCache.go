@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"github.com/jschoedt/go-firestorm"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// entryOverhead is the approximate size of an entry besides its key and entity
+const entryOverhead = 128
+
+// LRUCache is an in-memory cache bounded by the number of entities and their approximate size in bytes.
+// The least recently used entities are removed when a bound is exceeded
+type LRUCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	expiration time.Duration
+	size       int64
+	ll         *list.List // most recently used first
+	entries    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	item    firestorm.EntityMap
+	size    int64
+	expires time.Time
+}
+
+// NewLRUCache creates a cache holding at most maxEntries entities of maxBytes bytes in total. The entities expire after
+// the default expiration. Zero disables the bound or the expiration
+func NewLRUCache(maxEntries int, maxBytes int64, defaultExpiration time.Duration) *LRUCache {
+	return &LRUCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		expiration: defaultExpiration,
+		ll:         list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Len returns the number of cached entities including the expired entities not removed yet
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Size returns the approximate size in bytes of the cached entities
+func (c *LRUCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *LRUCache) Get(ctx context.Context, key string) (firestorm.EntityMap, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m, ok := c.get(key, time.Now()); ok {
+		return m, nil
+	}
+	return nil, firestorm.ErrCacheMiss
+}
+
+func (c *LRUCache) GetMulti(ctx context.Context, keys []string) (map[string]firestorm.EntityMap, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	result := make(map[string]firestorm.EntityMap, len(keys))
+	for _, key := range keys {
+		if m, ok := c.get(key, now); ok {
+			result[key] = m
+		}
+	}
+	return result, nil
+}
+
+func (c *LRUCache) Set(ctx context.Context, key string, item firestorm.EntityMap) error {
+	return c.SetMultiWithTTL(ctx, map[string]firestorm.EntityMap{key: item}, c.expiration)
+}
+
+func (c *LRUCache) SetMulti(ctx context.Context, items map[string]firestorm.EntityMap) error {
+	return c.SetMultiWithTTL(ctx, items, c.expiration)
+}
+
+// SetMultiWithTTL sets the entities with the given expiration. Implements firestorm.TTLCache
+func (c *LRUCache) SetMultiWithTTL(ctx context.Context, items map[string]firestorm.EntityMap, ttl time.Duration) error {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, item := range items {
+		c.set(key, item, expires)
+	}
+	return nil
+}
+
+func (c *LRUCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	return nil
+}
+
+func (c *LRUCache) DeleteMulti(ctx context.Context, keys []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := c.entries[key]; ok {
+			c.remove(e)
+		}
+	}
+	return nil
+}
+
+func (c *LRUCache) get(key string, now time.Time) (firestorm.EntityMap, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if !entry.expires.IsZero() && now.After(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.item.Copy(), true
+}
+
+func (c *LRUCache) set(key string, item firestorm.EntityMap, expires time.Time) {
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	size := int64(len(key)) + entryOverhead + sizeOf(item)
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return // would evict everything else
+	}
+	c.entries[key] = c.ll.PushFront(&lruEntry{key: key, item: item, size: size, expires: expires})
+	c.size += size
+	for (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) || (c.maxBytes > 0 && c.size > c.maxBytes) {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *LRUCache) remove(e *list.Element) {
+	entry := c.ll.Remove(e).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// sizeOf returns the approximate number of bytes used by the value
+func sizeOf(v interface{}) int64 {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(16 + len(v))
+	case []byte:
+		return int64(24 + len(v))
+	case time.Time:
+		return 24
+	case *latlng.LatLng:
+		return 32
+	case firestorm.EntityMap:
+		return sizeOf(map[string]interface{}(v))
+	case map[string]interface{}:
+		size := int64(48)
+		for k, elm := range v {
+			size += int64(16+len(k)) + 16 + sizeOf(elm)
+		}
+		return size
+	case []interface{}:
+		size := int64(24)
+		for _, elm := range v {
+			size += 16 + sizeOf(elm)
+		}
+		return size
+	case []string:
+		size := int64(24)
+		for _, elm := range v {
+			size += int64(16 + len(elm))
+		}
+		return size
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			return 8
+		}
+		return 8 + sizeOf(val.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		size := int64(24)
+		for i := 0; i < val.Len(); i++ {
+			size += sizeOf(val.Index(i).Interface())
+		}
+		return size
+	case reflect.Map:
+		size := int64(48)
+		iter := val.MapRange()
+		for iter.Next() {
+			size += sizeOf(iter.Key().Interface()) + sizeOf(iter.Value().Interface())
+		}
+		return size
+	}
+	return int64(val.Type().Size())
+}
@@ -0,0 +1,97 @@
+package cache_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/jschoedt/go-firestorm"
+	"github.com/jschoedt/go-firestorm/cache"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEntries(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewLRUCache(2, 0, 0)
+
+	c.Set(ctx, "Car/1", firestorm.EntityMap{"make": "Toyota"})
+	c.Set(ctx, "Car/2", firestorm.EntityMap{"make": "Jeep"})
+	// use car 1 so car 2 is the least recently used
+	if m, err := c.Get(ctx, "Car/1"); err != nil || m["make"] != "Toyota" {
+		t.Errorf("the car should have been cached: %v %v", m, err)
+	}
+	c.Set(ctx, "Car/3", firestorm.EntityMap{"make": "Volvo"})
+
+	if _, err := c.Get(ctx, "Car/2"); err != firestorm.ErrCacheMiss {
+		t.Errorf("the least recently used car should have been removed: %v", err)
+	}
+	if result, _ := c.GetMulti(ctx, []string{"Car/1", "Car/2", "Car/3"}); len(result) != 2 {
+		t.Errorf("car 1 and 3 should have been cached: %v", result)
+	}
+
+	c.DeleteMulti(ctx, []string{"Car/1", "Car/3"})
+	if c.Len() != 0 || c.Size() != 0 {
+		t.Errorf("the cache should be empty: %v %v", c.Len(), c.Size())
+	}
+}
+
+func TestLRUCacheBytes(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewLRUCache(0, 2000, 0)
+
+	items := make(map[string]firestorm.EntityMap)
+	for i := 0; i < 10; i++ {
+		items[fmt.Sprintf("Car/%d", i)] = firestorm.EntityMap{"make": strings.Repeat("x", 300)}
+	}
+	c.SetMulti(ctx, items)
+	if c.Size() > 2000 || c.Len() == 0 || c.Len() == 10 {
+		t.Errorf("the cache should have been bounded: %v entities of %v bytes", c.Len(), c.Size())
+	}
+
+	// entities larger than the cache are not cached
+	c.Set(ctx, "Car/big", firestorm.EntityMap{"data": make([]byte, 5000)})
+	if _, err := c.Get(ctx, "Car/big"); err != firestorm.ErrCacheMiss {
+		t.Errorf("the big car should not have been cached: %v", err)
+	}
+}
+
+func TestLRUCacheExpiration(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewLRUCache(0, 0, time.Hour)
+
+	c.Set(ctx, "Car/1", firestorm.EntityMap{"make": "Toyota"})
+	c.SetMultiWithTTL(ctx, map[string]firestorm.EntityMap{"Car/2": {"make": "Jeep"}}, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	if result, _ := c.GetMulti(ctx, []string{"Car/1", "Car/2"}); len(result) != 1 || result["Car/1"] == nil {
+		t.Errorf("only car 2 should have expired: %v", result)
+	}
+	if c.Len() != 1 {
+		t.Errorf("the expired car should have been removed: %v", c.Len())
+	}
+}
+
+func TestLRUCacheConcurrent(t *testing.T) {
+	ctx := context.Background()
+	c := cache.NewLRUCache(50, 0, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("Car/%d", (i*100+j)%80)
+				c.SetMulti(ctx, map[string]firestorm.EntityMap{key: {"make": key}})
+				if result, _ := c.GetMulti(ctx, []string{key, "Car/0"}); result[key] != nil && result[key]["make"] != key {
+					t.Errorf("wrong car: %v", result[key])
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if c.Len() > 50 {
+		t.Errorf("the cache should have been bounded: %v", c.Len())
+	}
+}
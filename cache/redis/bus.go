@@ -0,0 +1,73 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jschoedt/go-firestorm"
+	"github.com/redis/go-redis/v9"
+)
+
+// Bus a firestorm.InvalidationBus using redis pub/sub
+type Bus struct {
+	client  redis.UniversalClient
+	channel string
+	logger  firestorm.Logger
+}
+
+// NewRedisBus creates a bus publishing the invalidations on the redis channel. Invalid messages are logged to
+// the slog.Default() at the time of logging by default
+func NewRedisBus(client redis.UniversalClient, channel string) *Bus {
+	return &Bus{client: client, channel: channel, logger: firestorm.NewSlogLogger(nil)}
+}
+
+// SetLogger sets the logger of the invalid messages received on the channel. Set it to nil to disable logging
+func (b *Bus) SetLogger(logger firestorm.Logger) *Bus {
+	b.logger = logger
+	return b
+}
+
+func (b *Bus) Publish(ctx context.Context, inv firestorm.Invalidation) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel, data).Err()
+}
+
+// Subscribe subscribes to the channel and calls the handler from a goroutine until the context is done
+func (b *Bus) Subscribe(ctx context.Context, handler func(inv firestorm.Invalidation)) error {
+	sub := b.client.Subscribe(ctx, b.channel)
+	// wait for the subscription to be confirmed
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var inv firestorm.Invalidation
+				if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+					b.log(ctx, firestorm.LevelError, "Invalid invalidation", "op", "subscribe", "channel", b.channel, "err", err)
+					continue
+				}
+				handler(inv)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// log logs the message with the logger of the bus. Nothing is logged if the logger is nil
+func (b *Bus) log(ctx context.Context, level firestorm.LogLevel, msg string, fields ...interface{}) {
+	if b.logger != nil {
+		b.logger.Log(ctx, level, msg, fields...)
+	}
+}
@@ -0,0 +1,75 @@
+package redis_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jschoedt/go-firestorm"
+	rediscache "github.com/jschoedt/go-firestorm/cache/redis"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+func TestRedisBus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mr := miniredis.RunT(t)
+	bus := rediscache.NewRedisBus(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "invalidations")
+
+	received := make(chan firestorm.Invalidation, 1)
+	if err := bus.Subscribe(ctx, func(inv firestorm.Invalidation) { received <- inv }); err != nil {
+		t.Fatalf("the subscription should not fail: %v", err)
+	}
+	inv := firestorm.Invalidation{Source: "a", Keys: []string{"Car/1", "Car/2"}}
+	if err := bus.Publish(ctx, inv); err != nil {
+		t.Fatalf("the invalidation should have been published: %v", err)
+	}
+	select {
+	case got := <-received:
+		if !cmp.Equal(inv, got) {
+			t.Errorf("the invalidation should have been received: %v", cmp.Diff(inv, got))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the invalidation was not received")
+	}
+
+	// no more invalidations after the subscription is done
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if err := bus.Publish(context.Background(), inv); err != nil {
+		t.Fatalf("the invalidation should have been published: %v", err)
+	}
+	select {
+	case got := <-received:
+		t.Errorf("the invalidation should not have been received: %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisBusWithoutLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	bus := rediscache.NewRedisBus(client, "invalidations").SetLogger(nil)
+
+	received := make(chan firestorm.Invalidation, 1)
+	if err := bus.Subscribe(ctx, func(inv firestorm.Invalidation) { received <- inv }); err != nil {
+		t.Fatalf("the subscription should not fail: %v", err)
+	}
+	// the invalid message is not logged and the subscription continues
+	client.Publish(ctx, "invalidations", "not json")
+	inv := firestorm.Invalidation{Source: "a", Keys: []string{"Car/1"}}
+	if err := bus.Publish(ctx, inv); err != nil {
+		t.Fatalf("the invalidation should have been published: %v", err)
+	}
+	select {
+	case got := <-received:
+		if !cmp.Equal(inv, got) {
+			t.Errorf("the invalidation should have been received: %v", cmp.Diff(inv, got))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the invalidation was not received")
+	}
+}
@@ -0,0 +1,154 @@
+// Package redis is a second level cache for firestorm backed by redis so the cache can be shared between instances
+package redis
+
+import (
+	"context"
+	"github.com/jschoedt/go-firestorm"
+	"github.com/jschoedt/go-firestorm/codec"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// TTLFunc returns the time to live of the cached entity. Zero means no expiration
+type TTLFunc func(key string, item firestorm.EntityMap) time.Duration
+
+// Cache a firestorm.Cache storing the entities in redis
+type Cache struct {
+	client redis.UniversalClient
+	prefix string
+	ttl    TTLFunc
+	codec  codec.Codec
+}
+
+// NewRedisCache creates a cache using the redis client. The entities expire after the given duration. Zero means no
+// expiration. The entities are encoded with codec.Gob by default.
+func NewRedisCache(client redis.UniversalClient, expiration time.Duration) *Cache {
+	return &Cache{
+		client: client,
+		ttl: func(key string, item firestorm.EntityMap) time.Duration {
+			return expiration
+		},
+		codec: codec.Gob,
+	}
+}
+
+// SetPrefix sets a prefix that is added to all keys. Use it to share a redis database with other applications
+func (c *Cache) SetPrefix(prefix string) *Cache {
+	c.prefix = prefix
+	return c
+}
+
+// SetTTLFunc sets a func that decides the time to live of each cached entity eg. based on the collection in the key
+func (c *Cache) SetTTLFunc(ttl TTLFunc) *Cache {
+	c.ttl = ttl
+	return c
+}
+
+// SetCodec sets the codec used to convert the entities to and from bytes
+func (c *Cache) SetCodec(cdc codec.Codec) *Cache {
+	c.codec = cdc
+	return c
+}
+
+func (c *Cache) Get(ctx context.Context, key string) (firestorm.EntityMap, error) {
+	data, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, firestorm.ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	return c.codec.Unmarshal(data)
+}
+
+// GetMulti gets the entities with a pipelined GET per key. Unlike MGET it works with keys in different hash slots
+// of a Redis Cluster
+func (c *Cache) GetMulti(ctx context.Context, keys []string) (map[string]firestorm.EntityMap, error) {
+	result := make(map[string]firestorm.EntityMap, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := c.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = p.Get(ctx, c.prefix+key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		data, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue // not found
+		} else if err != nil {
+			return nil, err
+		}
+		m, err := c.codec.Unmarshal(data)
+		if err != nil {
+			return nil, err
+		}
+		result[keys[i]] = m
+	}
+	return result, nil
+}
+
+func (c *Cache) Set(ctx context.Context, key string, item firestorm.EntityMap) error {
+	data, err := c.codec.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(ctx, c.prefix+key, data, c.ttl(key, item)).Err()
+}
+
+// SetMulti sets the entities with a pipelined SET per key so they work with a Redis Cluster
+func (c *Cache) SetMulti(ctx context.Context, items map[string]firestorm.EntityMap) error {
+	return c.setMulti(ctx, items, c.ttl)
+}
+
+// SetMultiWithTTL sets the entities with the given time to live instead of the one from the TTLFunc.
+// Implements firestorm.TTLCache
+func (c *Cache) SetMultiWithTTL(ctx context.Context, items map[string]firestorm.EntityMap, ttl time.Duration) error {
+	return c.setMulti(ctx, items, func(key string, item firestorm.EntityMap) time.Duration {
+		return ttl
+	})
+}
+
+func (c *Cache) setMulti(ctx context.Context, items map[string]firestorm.EntityMap, ttlFunc TTLFunc) error {
+	if len(items) == 0 {
+		return nil
+	}
+	values := make(map[string][]byte, len(items))
+	for key, item := range items {
+		data, err := c.codec.Marshal(item)
+		if err != nil {
+			return err
+		}
+		values[key] = data
+	}
+	_, err := c.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for key, data := range values {
+			p.Set(ctx, c.prefix+key, data, ttlFunc(key, items[key]))
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *Cache) Delete(ctx context.Context, key string) error {
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+// DeleteMulti deletes the entities with a pipelined DEL per key so they work with a Redis Cluster
+func (c *Cache) DeleteMulti(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := c.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, key := range keys {
+			p.Del(ctx, c.prefix+key)
+		}
+		return nil
+	})
+	return err
+}
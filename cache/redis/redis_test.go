@@ -0,0 +1,134 @@
+package redis_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jschoedt/go-firestorm"
+	rediscache "github.com/jschoedt/go-firestorm/cache/redis"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRedisCache(t *testing.T) (*miniredis.Miniredis, *rediscache.Cache) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return mr, rediscache.NewRedisCache(client, time.Minute)
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	mr, c := newRedisCache(t)
+	c.SetPrefix("app:")
+
+	car := firestorm.EntityMap{
+		"make":     "Toyota",
+		"numbers":  []interface{}{int64(1), 2.5},
+		"year":     time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+		"location": &latlng.LatLng{Latitude: 55.7, Longitude: 12.6},
+		"driver":   map[string]interface{}{"name": "John"},
+		"data":     []byte("abc"),
+	}
+	if err := c.Set(ctx, "Car/1", car); err != nil {
+		t.Fatalf("the entity should have been cached: %v", err)
+	}
+	if !mr.Exists("app:Car/1") {
+		t.Errorf("the key should have been prefixed: %v", mr.Keys())
+	}
+	m, err := c.Get(ctx, "Car/1")
+	if err != nil {
+		t.Fatalf("the entity should be in the cache: %v", err)
+	}
+	if diff := cmp.Diff(car, m, cmp.Comparer(func(a, b *latlng.LatLng) bool {
+		return a.Latitude == b.Latitude && a.Longitude == b.Longitude
+	})); diff != "" {
+		t.Errorf("the entity should be unchanged: %s", diff)
+	}
+
+	if _, err := c.Get(ctx, "Car/2"); err != firestorm.ErrCacheMiss {
+		t.Errorf("a missing entity should be a cache miss: %v", err)
+	}
+
+	c.Delete(ctx, "Car/1")
+	if _, err := c.Get(ctx, "Car/1"); err != firestorm.ErrCacheMiss {
+		t.Errorf("the entity should have been deleted: %v", err)
+	}
+}
+
+func TestRedisCacheMulti(t *testing.T) {
+	ctx := context.Background()
+	mr, c := newRedisCache(t)
+	c.SetTTLFunc(func(key string, item firestorm.EntityMap) time.Duration {
+		if strings.HasPrefix(key, "Person/") {
+			return time.Second
+		}
+		return 0
+	})
+
+	items := map[string]firestorm.EntityMap{
+		"Car/1":    {"make": "Toyota"},
+		"Car/2":    {"make": "Volvo"},
+		"Person/1": {"name": "John"},
+	}
+	if err := c.SetMulti(ctx, items); err != nil {
+		t.Fatalf("the entities should have been cached: %v", err)
+	}
+	if ttl := mr.TTL("Person/1"); ttl != time.Second {
+		t.Errorf("the person should expire: %v", ttl)
+	}
+	if ttl := mr.TTL("Car/1"); ttl != 0 {
+		t.Errorf("the car should not expire: %v", ttl)
+	}
+
+	result, err := c.GetMulti(ctx, []string{"Car/1", "Car/2", "Car/3", "Person/1"})
+	if err != nil {
+		t.Fatalf("the entities should be in the cache: %v", err)
+	}
+	if len(result) != 3 || result["Car/2"]["make"] != "Volvo" {
+		t.Errorf("the found entities should be returned: %v", result)
+	}
+
+	c.SetMultiWithTTL(ctx, map[string]firestorm.EntityMap{"Car/4": {"make": "Audi"}}, time.Hour)
+	if ttl := mr.TTL("Car/4"); ttl != time.Hour {
+		t.Errorf("the car should expire with the given ttl: %v", ttl)
+	}
+
+	mr.FastForward(2 * time.Second)
+	if _, err := c.Get(ctx, "Person/1"); err != firestorm.ErrCacheMiss {
+		t.Errorf("the person should have expired: %v", err)
+	}
+
+	c.DeleteMulti(ctx, []string{"Car/1", "Car/2"})
+	if result, _ := c.GetMulti(ctx, []string{"Car/1", "Car/2"}); len(result) != 0 {
+		t.Errorf("the entities should have been deleted: %v", result)
+	}
+}
+
+func TestRedisCacheCluster(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	c := rediscache.NewRedisCache(client, time.Minute)
+
+	// the keys are in different hash slots
+	items := map[string]firestorm.EntityMap{
+		"Car/1":    {"make": "Toyota"},
+		"Person/1": {"name": "John"},
+	}
+	if err := c.SetMulti(ctx, items); err != nil {
+		t.Fatalf("the entities should have been cached: %v", err)
+	}
+	result, err := c.GetMulti(ctx, []string{"Car/1", "Car/2", "Person/1"})
+	if err != nil || len(result) != 2 || result["Person/1"]["name"] != "John" {
+		t.Fatalf("the found entities should be returned: %v %v", result, err)
+	}
+	if err := c.DeleteMulti(ctx, []string{"Car/1", "Person/1"}); err != nil {
+		t.Fatalf("the entities should have been deleted: %v", err)
+	}
+	if result, _ := c.GetMulti(ctx, []string{"Car/1", "Person/1"}); len(result) != 0 {
+		t.Errorf("the entities should have been deleted: %v", result)
+	}
+}
@@ -0,0 +1,89 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"github.com/jschoedt/go-firestorm/codec"
+	"testing"
+	"time"
+)
+
+func TestCachableNestedRefs(t *testing.T) {
+	// the entities are only encoded so the emulator does not need to run
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	client, err := firestore.NewClient(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c := newCacheWrapper(client, newDefaultCache(), nil)
+	spouse, friend := client.Doc("Person/spouse"), client.Doc("Person/friend")
+
+	for name, cdc := range map[string]codec.Codec{"json": codec.JSON, "gob": codec.Gob, "msgpack": codec.Msgpack} {
+		driver := map[string]interface{}{"name": "John", "spouse": spouse}
+		relations := []map[string]interface{}{{"name": "friends", "friends": []interface{}{friend}}}
+		m := map[string]interface{}{"driver": driver, "relations": relations}
+
+		c.makeCachable(m)
+		if _, ok := driver["spouse"].(*firestore.DocumentRef); !ok {
+			t.Errorf("%s: the nested map of the entity should not have been modified: %v", name, driver)
+		}
+		data, err := cdc.Marshal(m)
+		if err != nil {
+			t.Fatalf("%s: the nested refs should have been encoded: %v", name, err)
+		}
+		out, err := cdc.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%s: the entity should have been decoded: %v", name, err)
+		}
+		c.makeUnCachable(out)
+
+		if ref, ok := out["driver"].(map[string]interface{})["spouse"].(*firestore.DocumentRef); !ok || ref.Path != spouse.Path {
+			t.Errorf("%s: the nested ref should have been restored: %v", name, out["driver"])
+		}
+		rels, _ := out["relations"].([]interface{})
+		if len(rels) != 1 {
+			t.Fatalf("%s: the relations should have been restored: %v", name, out["relations"])
+		}
+		friends, _ := rels[0].(map[string]interface{})["friends"].([]interface{})
+		if len(friends) != 1 || friends[0].(*firestore.DocumentRef).Path != friend.Path {
+			t.Errorf("%s: the refs in the slice of maps should have been restored: %v", name, rels[0])
+		}
+	}
+}
+
+func TestKeepCreateTimes(t *testing.T) {
+	// the writes are only cached so the emulator does not need to run
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	client, err := firestore.NewClient(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fsc := New(client, "ID", "")
+	fsc.CreateTimeKey = "Created"
+	ctx := context.WithValue(context.Background(), SessionCacheKey, make(map[string]EntityMap))
+
+	created := time.Now().Add(-time.Hour)
+	cached, unknown := client.Doc("Car/cached"), client.Doc("Car/unknown")
+	fsc.Cache.SetMulti(ctx, map[string]EntityMap{
+		cached.Path:  withMetadata(EntityMap{"make": "Toyota"}, metadata{createTime: created}),
+		unknown.Path: {"make": "Jeep"},
+	})
+
+	updated := time.Now()
+	fsc.updateCache(ctx,
+		write{op: setOp, ref: cached, data: map[string]interface{}{"make": "Volvo"}, updateTime: updated},
+		write{op: setOp, ref: unknown, data: map[string]interface{}{"make": "Audi"}, updateTime: updated})
+
+	m, err := fsc.Cache.first.Get(ctx, cached.Path)
+	if err != nil || m["make"] != "Volvo" {
+		t.Fatalf("the set entity should have been written to the cache: %v %v", m, err)
+	}
+	if md := popMetadata(m); !md.createTime.Equal(created) || !md.updateTime.Equal(updated) {
+		t.Errorf("the create time should have been kept: %v", md)
+	}
+	if m, err := fsc.Cache.first.Get(ctx, unknown.Path); err != ErrCacheMiss {
+		t.Errorf("the entity without a create time should have been evicted: %v %v", m, err)
+	}
+}
@@ -0,0 +1,153 @@
+package firestorm
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachePolicy decides how the entities of a collection are cached in the second level cache.
+// The zero value caches the entities with the default expiration of the cache and writes them through on updates.
+type CachePolicy struct {
+	// NoCache never stores the entities in the second level cache. The session cache is still used
+	NoCache bool
+	// TTL is the time to live in the second level cache. Zero uses the default expiration of the cache.
+	// The cache must implement TTLCache
+	TTL time.Duration
+	// Invalidate removes the entities from the second level cache when they are written instead of writing them
+	// through. They are cached again on the next read
+	Invalidate bool
+	// NotFoundTTL caches that documents do not exist for the duration so reading them again returns a NotFoundError
+	// without reading firestore. The entries are removed when the documents are written. Zero disables it.
+	// The cache must implement TTLCache - otherwise the default expiration of the cache is used
+	NotFoundTTL time.Duration
+}
+
+// TTLCache is implemented by second level caches that support a time to live per entity
+type TTLCache interface {
+	SetMultiWithTTL(ctx context.Context, items map[string]EntityMap, ttl time.Duration) error
+}
+
+// SetCachePolicy sets the policy of the second level cache for the collection. The entities in sub-collections
+// are matched by the name of the sub-collection
+func (fsc *FSClient) SetCachePolicy(collection string, policy CachePolicy) {
+	fsc.Cache.policies.set(collection, policy)
+}
+
+// SetDefaultCachePolicy sets the policy of the second level cache for the collections without a policy
+func (fsc *FSClient) SetDefaultCachePolicy(policy CachePolicy) {
+	fsc.Cache.policies.setDefault(policy)
+}
+
+// SetTypeCachePolicy sets the policy of the second level cache for the collection of the entity type
+func (fsc *FSClient) SetTypeCachePolicy(entity interface{}, policy CachePolicy) {
+	fsc.SetCachePolicy(getTypeName(entity), policy)
+}
+
+type cachePolicies struct {
+	sync.RWMutex
+	policies map[string]CachePolicy
+	def      CachePolicy
+}
+
+func newCachePolicies() *cachePolicies {
+	return &cachePolicies{policies: make(map[string]CachePolicy)}
+}
+
+func (p *cachePolicies) set(collection string, policy CachePolicy) {
+	p.Lock()
+	defer p.Unlock()
+	p.policies[collection] = policy
+}
+
+func (p *cachePolicies) setDefault(policy CachePolicy) {
+	p.Lock()
+	defer p.Unlock()
+	p.def = policy
+}
+
+// get gets the policy of the collection of the document path
+func (p *cachePolicies) get(path string) CachePolicy {
+	p.RLock()
+	defer p.RUnlock()
+	if policy, ok := p.policies[collectionID(path)]; ok {
+		return policy
+	}
+	return p.def
+}
+
+// cached filters the keys that may be read from the second level cache
+func (p *cachePolicies) cached(keys []string) []string {
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !p.get(key).NoCache {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// notFoundKey marks the entries in the second level cache of the documents that do not exist
+const notFoundKey = "_notFound"
+
+// fromSecond converts the not found entries read from the second level cache to nil
+func fromSecond(m EntityMap) EntityMap {
+	if found, ok := m[notFoundKey].(bool); ok && found {
+		return nil
+	}
+	return m
+}
+
+// collectionID returns the id of the collection of the document path
+func collectionID(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+// setSecond stores the items in the second level cache according to their policies. Written items are removed
+// instead if the policy invalidates on writes. Nil items are documents not found. They are only stored if the
+// policy caches them
+func (c *cacheWrapper) setSecond(ctx context.Context, items map[string]EntityMap, written bool) error {
+	if c.second == nil || len(items) == 0 {
+		return nil
+	}
+	byTTL := make(map[time.Duration]map[string]EntityMap)
+	var invalidate []string
+	for key, item := range items {
+		policy := c.policies.get(key)
+		ttl := policy.TTL
+		switch {
+		case policy.NoCache:
+		case item == nil && policy.NotFoundTTL <= 0:
+		case item == nil:
+			ttl = policy.NotFoundTTL
+			item = EntityMap{notFoundKey: true}
+			fallthrough
+		case !written || !policy.Invalidate:
+			if byTTL[ttl] == nil {
+				byTTL[ttl] = make(map[string]EntityMap)
+			}
+			byTTL[ttl][key] = item
+		default:
+			invalidate = append(invalidate, key)
+		}
+	}
+	for ttl, multi := range byTTL {
+		start := time.Now()
+		var err error
+		if ttlCache, ok := c.second.(TTLCache); ok && ttl > 0 {
+			err = ttlCache.SetMultiWithTTL(ctx, multi, ttl)
+		} else {
+			err = c.second.SetMulti(ctx, multi)
+		}
+		c.stats.observe(secondLevel, start, err)
+		if err != nil {
+			return err
+		}
+	}
+	return c.deleteSecondMulti(ctx, invalidate)
+}
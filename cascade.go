@@ -0,0 +1,243 @@
+package firestorm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// cascadeEntities writes the entities along with the entities they reference on the cascade paths.
+// The ids of all new entities are created before any of the entities are mapped so the references (even cyclic ones)
+// point to the right documents. The referenced entities are written level by level with the deepest references first
+// and an entity is only written if all its referenced entities were written. Atomic requests and transactions write
+// everything at once.
+func (fsc *FSClient) cascadeEntities(ctx context.Context, req *Request, sliceVal reflect.Value, toWrite func(entity interface{}) (write, error)) FutureFunc {
+	asyncFunc := func() error {
+		// the entities are written by toWrite so they should not be cascaded
+		g := &cascadeGraph{isEntity: fsc.IsEntity, entities: make(map[uintptr]bool), nodes: make(map[uintptr]*cascadeNode)}
+		for i := 0; i < sliceVal.Len(); i++ {
+			if v := reflect.ValueOf(sliceVal.Index(i).Interface()); v.Kind() == reflect.Ptr {
+				g.entities[v.Pointer()] = true
+			}
+		}
+
+		// collect the referenced entities of each entity and create the missing ids
+		refs := make([][]*cascadeNode, sliceVal.Len())
+		for i := 0; i < sliceVal.Len(); i++ {
+			refs[i] = g.refs(reflect.ValueOf(sliceVal.Index(i).Interface()), req.cascadePaths)
+		}
+		for _, n := range g.order {
+			if req.GetID(n.entity) == "" {
+				req.SetID(n.entity, req.ToCollection(n.entity).NewDoc().ID)
+				n.created = true
+			}
+		}
+		for i := 0; i < sliceVal.Len(); i++ {
+			if entity := sliceVal.Index(i).Interface(); reflect.ValueOf(entity).Kind() == reflect.Ptr && req.GetID(entity) == "" {
+				req.SetID(entity, req.ToCollection(entity).NewDoc().ID)
+			}
+		}
+
+		var errs []EntityError
+		_, inTransaction := getTransaction(ctx)
+		atOnce := inTransaction || req.atomic
+		nodes := make(map[string]*cascadeNode, len(g.order))
+		var refWrites []write
+		for _, level := range g.levels() {
+			var writes []write
+			for _, n := range level {
+				if err := failedRef(req, n.deps); err != nil {
+					n.err = err
+					errs = append(errs, EntityError{Index: -1, Entity: n.entity, Ref: req.ToRef(n.entity), Err: err})
+					continue
+				}
+				w, err := fsc.toCascadeWrite(ctx, req, n.entity, n.created)
+				if err != nil {
+					n.err = err
+					errs = append(errs, EntityError{Index: -1, Entity: n.entity, Ref: req.ToRef(n.entity), Err: err})
+					continue
+				}
+				if w.isNoop() {
+					continue
+				}
+				w.index = -1
+				nodes[w.ref.Path] = n
+				writes = append(writes, w)
+			}
+			if atOnce {
+				refWrites = append(refWrites, writes...)
+				continue
+			}
+			for _, err := range fsc.commitWrites(ctx, writes, false) {
+				errs = append(errs, err)
+				if n, ok := nodes[err.Ref.Path]; ok {
+					n.err = err.Err
+				}
+			}
+		}
+
+		writes := refWrites
+		for i := 0; i < sliceVal.Len(); i++ {
+			entity := sliceVal.Index(i).Interface()
+			if err := failedRef(req, refs[i]); err != nil {
+				errs = append(errs, EntityError{Index: i, Entity: entity, Ref: req.ToRef(entity), Err: err})
+				continue
+			}
+			w, err := toWrite(entity)
+			if err != nil {
+				errs = append(errs, EntityError{Index: i, Entity: entity, Err: err})
+				continue
+			}
+			if w.isNoop() {
+				continue
+			}
+			w.index = i
+			writes = append(writes, w)
+		}
+		return fsc.applyWrites(ctx, req, writes, errs)
+	}
+	return runAsync(ctx, asyncFunc)
+}
+
+// failedRef returns an error if any of the referenced entities failed
+func failedRef(req *Request, deps []*cascadeNode) error {
+	for _, d := range deps {
+		if d.err != nil {
+			return fmt.Errorf("referenced entity %s was not written: %w", req.ToRef(d.entity).Path, d.err)
+		}
+	}
+	return nil
+}
+
+// cascadeNode is a referenced entity that is written by a cascade
+type cascadeNode struct {
+	entity  interface{}
+	deps    []*cascadeNode // the referenced entities this entity depends on
+	level   int            // 0 if the entity has no dependencies - otherwise one more than its deepest dependency
+	created bool
+	err     error
+	visit   bool // true while the references of the entity are being collected
+}
+
+// cascadeGraph collects the entities referenced on the cascade paths. An edge that closes a cycle is ignored as the
+// ids of the entities are created before they are written
+type cascadeGraph struct {
+	isEntity func(i interface{}) bool
+	entities map[uintptr]bool // the entities written by the request
+	nodes    map[uintptr]*cascadeNode
+	order    []*cascadeNode
+}
+
+// levels returns the referenced entities grouped by level starting with the deepest references
+func (g *cascadeGraph) levels() [][]*cascadeNode {
+	var result [][]*cascadeNode
+	for _, n := range g.order {
+		for len(result) <= n.level {
+			result = append(result, nil)
+		}
+		result[n.level] = append(result[n.level], n)
+	}
+	return result
+}
+
+// refs returns the entities referenced directly by the struct on the paths
+func (g *cascadeGraph) refs(v reflect.Value, paths []string) []*cascadeNode {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct || len(paths) == 0 {
+		return nil
+	}
+	var result []*cascadeNode
+	add := func(p reflect.Value, next []string) {
+		if n := g.node(p, next); n != nil {
+			result = append(result, n)
+		}
+	}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		sf := v.Type().Field(i)
+		if sf.Anonymous && f.Kind() == reflect.Struct {
+			result = append(result, g.refs(f, paths)...)
+			continue
+		}
+		next, ok := nextCascadePaths(sf, paths)
+		if !ok || !f.CanInterface() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Ptr:
+			add(f, next)
+		case reflect.Slice:
+			for j := 0; j < f.Len(); j++ {
+				elm := f.Index(j)
+				if elm.Kind() == reflect.Struct {
+					elm = elm.Addr()
+				}
+				add(elm, next)
+			}
+		}
+	}
+	return result
+}
+
+// node returns the node of the referenced entity and collects its references the first time it is visited
+func (g *cascadeGraph) node(p reflect.Value, paths []string) *cascadeNode {
+	if p.Kind() != reflect.Ptr || p.IsNil() || p.Elem().Kind() != reflect.Struct || !g.isEntity(p) {
+		return nil
+	}
+	if g.entities[p.Pointer()] {
+		return nil
+	}
+	if n, ok := g.nodes[p.Pointer()]; ok {
+		if n.visit {
+			return nil
+		}
+		return n
+	}
+	n := &cascadeNode{entity: p.Interface(), visit: true}
+	g.nodes[p.Pointer()] = n
+	n.deps = g.refs(p, paths)
+	for _, d := range n.deps {
+		if d.level >= n.level {
+			n.level = d.level + 1
+		}
+	}
+	n.visit = false
+	g.order = append(g.order, n)
+	return n
+}
+
+// toCascadeWrite creates the referenced entity if it is new - otherwise it is updated
+func (fsc *FSClient) toCascadeWrite(ctx context.Context, req *Request, entity interface{}, created bool) (write, error) {
+	if created {
+		return fsc.toCreateWrite(ctx, req, entity)
+	}
+	return fsc.toSetWrite(ctx, req, entity)
+}
+
+// nextCascadePaths checks if the field is on any of the paths and returns the remaining paths below the field
+func nextCascadePaths(sf reflect.StructField, paths []string) ([]string, bool) {
+	name := sf.Name
+	if tag, ok := parseTag(sf); ok && tag.ignore {
+		return nil, false
+	} else if ok && tag.name != "" {
+		name = tag.name
+	}
+	var next []string
+	found := false
+	for _, path := range paths {
+		if path == AllEntities {
+			next = append(next, AllEntities)
+			found = true
+			continue
+		}
+		first, rest, _ := strings.Cut(path, ".")
+		if strings.EqualFold(first, name) || strings.EqualFold(first, sf.Name) {
+			found = true
+			if rest != "" {
+				next = append(next, rest)
+			}
+		}
+	}
+	return next, found
+}
@@ -0,0 +1,111 @@
+// Package codec serializes the entity maps cached by firestorm. The codecs round trip all the types firestore
+// supports: nil, bool, int64, float64, string, []byte, time.Time, *latlng.LatLng, []interface{} and map[string]interface{}.
+// Other integer and float types are decoded as int64 and float64 and other slices as []interface{} the same way
+// firestore returns them.
+package codec
+
+import (
+	"fmt"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Codec converts the entity maps to and from bytes
+type Codec interface {
+	Marshal(m map[string]interface{}) ([]byte, error)
+	Unmarshal(data []byte) (map[string]interface{}, error)
+}
+
+var (
+	// JSON encodes the entities as JSON with type hints for the types JSON does not support
+	JSON Codec = jsonCodec{}
+	// Gob encodes the entities using encoding/gob
+	Gob Codec = gobCodec{}
+	// Msgpack encodes the entities using MessagePack
+	Msgpack Codec = msgpackCodec{}
+)
+
+// normalize converts the values to the types firestore returns eg. ints to int64 and slices to []interface{}.
+// An error is returned for unsupported types
+func normalize(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case *latlng.LatLng:
+		if v == nil {
+			return nil, nil
+		}
+		return v, nil
+	case nil, bool, string, int64, float64, []byte, time.Time:
+		return v, nil
+	case map[string]interface{}:
+		return normalizeMap(v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("codec: uint overflows int64: %v", v)
+		}
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return normalize(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, nil
+		}
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			return rv.Bytes(), nil
+		}
+		result := make([]interface{}, rv.Len())
+		for i := range result {
+			n, err := normalize(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			result[i] = n
+		}
+		return result, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.IsNil() {
+			return nil, nil
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = iter.Value().Interface()
+		}
+		return normalizeMap(m)
+	}
+	return nil, fmt.Errorf("codec: type not supported: %T", v)
+}
+
+func normalizeMap(m map[string]interface{}) (map[string]interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		n, err := normalize(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		result[k] = n
+	}
+	return result, nil
+}
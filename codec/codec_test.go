@@ -0,0 +1,87 @@
+package codec_test
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jschoedt/go-firestorm/codec"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"math"
+	"testing"
+	"time"
+)
+
+var codecs = map[string]codec.Codec{
+	"json":    codec.JSON,
+	"gob":     codec.Gob,
+	"msgpack": codec.Msgpack,
+}
+
+var latLngComparer = cmp.Comparer(func(a, b *latlng.LatLng) bool {
+	return a.Latitude == b.Latitude && a.Longitude == b.Longitude
+})
+
+func TestRoundTrip(t *testing.T) {
+	in := map[string]interface{}{
+		"nil":                 nil,
+		"bool":                true,
+		"int":                 int64(math.MaxInt64),
+		"negative":            int64(-42),
+		"float":               2.5,
+		"whole":               3.0,
+		"string":              "$int",
+		"bytes":               []byte{0, 1, 2},
+		"time":                time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC),
+		"location":            &latlng.LatLng{Latitude: 55.7, Longitude: 12.6},
+		"array":               []interface{}{int64(1), "a", nil, map[string]interface{}{"b": 1.5}},
+		"nested":              map[string]interface{}{"$int": "not a hint", "deep": map[string]interface{}{"time": time.Unix(0, 0).UTC()}},
+		"empty":               map[string]interface{}{},
+		"_cacheElement_owner": "Person/1",
+	}
+	for name, c := range codecs {
+		data, err := c.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: the map should have been encoded: %v", name, err)
+		}
+		out, err := c.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%s: the map should have been decoded: %v", name, err)
+		}
+		if diff := cmp.Diff(in, out, latLngComparer); diff != "" {
+			t.Errorf("%s: the map should be unchanged: %s", name, diff)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	type color string
+	in := map[string]interface{}{
+		"int":     1,
+		"int32":   int32(2),
+		"float32": float32(1.5),
+		"tags":    []string{"a", "b"},
+		"color":   color("red"),
+		"owners":  map[string]int{"john": 1},
+	}
+	want := map[string]interface{}{
+		"int":     int64(1),
+		"int32":   int64(2),
+		"float32": 1.5,
+		"tags":    []interface{}{"a", "b"},
+		"color":   "red",
+		"owners":  map[string]interface{}{"john": int64(1)},
+	}
+	for name, c := range codecs {
+		data, _ := c.Marshal(in)
+		out, _ := c.Unmarshal(data)
+		if diff := cmp.Diff(want, out); diff != "" {
+			t.Errorf("%s: the numbers should be decoded as firestore returns them: %s", name, diff)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for name, c := range codecs {
+		if _, err := c.Marshal(map[string]interface{}{"c": make(chan int)}); err == nil {
+			t.Errorf("%s: an unsupported type should fail", name)
+		}
+	}
+}
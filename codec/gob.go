@@ -0,0 +1,65 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"time"
+)
+
+func init() {
+	// the types firestore returns as interface values
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+	gob.Register(&latlng.LatLng{})
+	gob.Register(gobNull{})
+}
+
+// gobNull replaces nil values as gob cannot encode nil interface values
+type gobNull struct {
+	Null bool
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(m map[string]interface{}) ([]byte, error) {
+	m, err := normalizeMap(m)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(replaceNils(m, nil, gobNull{true}))
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, nil
+	}
+	return replaceNils(m, gobNull{true}, nil).(map[string]interface{}), nil
+}
+
+// replaceNils replaces the from values with the to value in the nested maps and slices
+func replaceNils(v interface{}, from, to interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, elm := range t {
+			t[k] = replaceNils(elm, from, to)
+		}
+		return t
+	case []interface{}:
+		for i, elm := range t {
+			t[i] = replaceNils(elm, from, to)
+		}
+		return t
+	}
+	if v == from {
+		return to
+	}
+	return v
+}
@@ -0,0 +1,152 @@
+package codec
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the type hints. A value with a type hint is encoded as an object with the hint as the only key
+const (
+	intHint    = "$int"
+	floatHint  = "$float"
+	timeHint   = "$time"
+	bytesHint  = "$bytes"
+	latLngHint = "$latlng"
+	mapHint    = "$map" // a map with keys that could be mistaken for hints
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(m map[string]interface{}) ([]byte, error) {
+	m, err := normalizeMap(m)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(hintMap(m))
+}
+
+func (jsonCodec) Unmarshal(data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	v, err := unhint(m)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+func hint(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int64:
+		return map[string]interface{}{intHint: strconv.FormatInt(v, 10)}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return map[string]interface{}{floatHint: strconv.FormatFloat(v, 'g', -1, 64)}
+		}
+		return v
+	case time.Time:
+		return map[string]interface{}{timeHint: v.Format(time.RFC3339Nano)}
+	case []byte:
+		return map[string]interface{}{bytesHint: base64.StdEncoding.EncodeToString(v)}
+	case *latlng.LatLng:
+		if v == nil {
+			return nil
+		}
+		return map[string]interface{}{latLngHint: []float64{v.Latitude, v.Longitude}}
+	case map[string]interface{}:
+		return hintMap(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elm := range v {
+			result[i] = hint(elm)
+		}
+		return result
+	}
+	return v
+}
+
+func hintMap(m map[string]interface{}) interface{} {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(m))
+	escape := false
+	for k, v := range m {
+		result[k] = hint(v)
+		escape = escape || strings.HasPrefix(k, "$")
+	}
+	if escape {
+		return map[string]interface{}{mapHint: result}
+	}
+	return result
+}
+
+func unhint(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for k, hinted := range v {
+				if strings.HasPrefix(k, "$") {
+					return unhintValue(k, hinted)
+				}
+			}
+		}
+		return unhintMap(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elm := range v {
+			u, err := unhint(elm)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = u
+		}
+		return result, nil
+	}
+	return v, nil
+}
+
+func unhintMap(m map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		u, err := unhint(v)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = u
+	}
+	return result, nil
+}
+
+func unhintValue(hint string, v interface{}) (interface{}, error) {
+	s, _ := v.(string)
+	switch hint {
+	case intHint:
+		return strconv.ParseInt(s, 10, 64)
+	case floatHint:
+		return strconv.ParseFloat(s, 64)
+	case timeHint:
+		return time.Parse(time.RFC3339Nano, s)
+	case bytesHint:
+		return base64.StdEncoding.DecodeString(s)
+	case latLngHint:
+		if ll, ok := v.([]interface{}); ok && len(ll) == 2 {
+			lat, _ := ll[0].(float64)
+			lng, _ := ll[1].(float64)
+			return &latlng.LatLng{Latitude: lat, Longitude: lng}, nil
+		}
+	case mapHint:
+		if m, ok := v.(map[string]interface{}); ok {
+			return unhintMap(m)
+		}
+	}
+	return nil, fmt.Errorf("codec: invalid type hint: %s", hint)
+}
@@ -0,0 +1,48 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"reflect"
+)
+
+// latLngExtID is the msgpack extension type of *latlng.LatLng
+const latLngExtID = 1
+
+func init() {
+	msgpack.RegisterExtEncoder(latLngExtID, (*latlng.LatLng)(nil), func(e *msgpack.Encoder, v reflect.Value) ([]byte, error) {
+		ll := v.Interface().(*latlng.LatLng)
+		return msgpack.Marshal([]float64{ll.Latitude, ll.Longitude})
+	})
+	msgpack.RegisterExtDecoder(latLngExtID, (*latlng.LatLng)(nil), func(d *msgpack.Decoder, v reflect.Value, extLen int) error {
+		var ll []float64
+		if err := d.Decode(&ll); err != nil {
+			return err
+		}
+		if len(ll) == 2 {
+			v.Set(reflect.ValueOf(&latlng.LatLng{Latitude: ll[0], Longitude: ll[1]}))
+		}
+		return nil
+	})
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(m map[string]interface{}) ([]byte, error) {
+	m, err := normalizeMap(m)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(false) // keep int64 so it is not decoded as a smaller int type
+	err = enc.Encode(m)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) Unmarshal(data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	err := msgpack.Unmarshal(data, &m)
+	return m, err
+}
@@ -44,26 +44,47 @@ func query(ctx context.Context, query firestore.Query) ([]*firestore.DocumentSna
 	return query.Documents(ctx).GetAll()
 }
 
-func create(ctx context.Context, ref *firestore.DocumentRef, m map[string]interface{}) error {
+func create(ctx context.Context, ref *firestore.DocumentRef, m map[string]interface{}) (*firestore.WriteResult, error) {
 	if t, ok := getTransaction(ctx); ok {
-		return t.Create(ref, m)
+		return nil, t.Create(ref, m)
 	}
-	_, err := ref.Create(ctx, m)
-	return err
+	return ref.Create(ctx, m)
 }
 
-func set(ctx context.Context, ref *firestore.DocumentRef, m map[string]interface{}) error {
+func set(ctx context.Context, ref *firestore.DocumentRef, m map[string]interface{}, opts ...firestore.SetOption) (*firestore.WriteResult, error) {
 	if t, ok := getTransaction(ctx); ok {
-		return t.Set(ref, m)
+		return nil, t.Set(ref, m, opts...)
 	}
-	_, err := ref.Set(ctx, m)
-	return err
+	return ref.Set(ctx, m, opts...)
 }
 
-func del(ctx context.Context, ref *firestore.DocumentRef) error {
+func update(ctx context.Context, ref *firestore.DocumentRef, updates []firestore.Update, preconds ...firestore.Precondition) (*firestore.WriteResult, error) {
 	if t, ok := getTransaction(ctx); ok {
-		return t.Delete(ref)
+		return nil, t.Update(ref, updates, preconds...)
 	}
-	_, err := ref.Delete(ctx)
-	return err
+	return ref.Update(ctx, updates, preconds...)
+}
+
+func del(ctx context.Context, ref *firestore.DocumentRef, preconds ...firestore.Precondition) (*firestore.WriteResult, error) {
+	if t, ok := getTransaction(ctx); ok {
+		return nil, t.Delete(ref, preconds...)
+	}
+	return ref.Delete(ctx, preconds...)
+}
+
+func commit(ctx context.Context, client *firestore.Client, writes []write) ([]*firestore.WriteResult, error) {
+	b := client.Batch()
+	for _, w := range writes {
+		switch w.op {
+		case createOp:
+			b.Create(w.ref, w.data)
+		case setOp:
+			b.Set(w.ref, w.data, w.setOptions()...)
+		case updateOp:
+			b.Update(w.ref, w.updates, w.preconditions()...)
+		case deleteOp:
+			b.Delete(w.ref, w.preconditions()...)
+		}
+	}
+	return b.Commit(ctx)
 }
@@ -0,0 +1,155 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"reflect"
+	"time"
+)
+
+// the normalized values of the firestore types that cannot be compared with reflect.DeepEqual
+type refValue struct{ path string }
+type timeValue struct{ nanos int64 }
+type bytesValue struct{ b string }
+
+// diff returns the updates needed to change the old entity map into the new one. Nested maps are
+// compared field by field so only the changed nested fields are updated.
+func diff(path firestore.FieldPath, old, new map[string]interface{}) []firestore.Update {
+	var updates []firestore.Update
+	for k, nv := range new {
+		fp := append(append(firestore.FieldPath{}, path...), k)
+		ov, ok := old[k]
+		if !ok {
+			updates = append(updates, firestore.Update{FieldPath: fp, Value: nv})
+			continue
+		}
+		om, oIsMap := ov.(map[string]interface{})
+		nm, nIsMap := nv.(map[string]interface{})
+		if oIsMap && nIsMap {
+			updates = append(updates, diff(fp, om, nm)...)
+		} else if !reflect.DeepEqual(normalize(ov), normalize(nv)) {
+			updates = append(updates, firestore.Update{FieldPath: fp, Value: nv})
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			fp := append(append(firestore.FieldPath{}, path...), k)
+			updates = append(updates, firestore.Update{FieldPath: fp, Value: firestore.Delete})
+		}
+	}
+	return updates
+}
+
+// normalize converts the value to the types firestore returns so values mapped from an entity
+// can be compared with values loaded from firestore
+func normalize(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case *firestore.DocumentRef:
+		if val == nil {
+			return nil
+		}
+		return refValue{val.Path}
+	case time.Time:
+		return timeValue{val.Truncate(time.Microsecond).UnixNano()} // firestore stores microseconds
+	case []byte:
+		return bytesValue{string(val)}
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.String:
+		return rv.String()
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return normalize(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		result := make([]interface{}, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			result[i] = normalize(rv.Index(i).Interface())
+		}
+		return result
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		result := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			result[k.String()] = normalize(rv.MapIndex(k).Interface())
+		}
+		return result
+	}
+	return v
+}
+
+// toChangesWrite turns the set write into an update of the fields changed since the snapshot was taken
+func (w write) toChangesWrite(snapshot EntityMap) write {
+	w.op = updateOp
+	w.updates = diff(nil, snapshot, w.data)
+	return w
+}
+
+// isNoop is true if the write does not change anything and can be skipped
+func (w write) isNoop() bool {
+	return w.op == updateOp && len(w.updates) == 0
+}
+
+// withPrecondition makes the write fail if the document has been updated since the update time.
+// Set writes are turned into updates replacing the fields of the snapshot as firestore only
+// supports preconditions on updates and deletes.
+func (w write) withPrecondition(snapshot EntityMap, updateTime time.Time) write {
+	if updateTime.IsZero() {
+		return w
+	}
+	if w.op == setOp {
+		w.op = updateOp
+		if w.merge {
+			w.updates = mergeUpdates(nil, w.data)
+		} else {
+			w.updates = replaceUpdates(snapshot, w.data)
+		}
+	}
+	w.lastUpdate = updateTime
+	return w
+}
+
+// replaceUpdates returns the updates replacing the fields of the old entity map with the fields of the new one
+func replaceUpdates(old, new map[string]interface{}) []firestore.Update {
+	updates := make([]firestore.Update, 0, len(new))
+	for k, v := range new {
+		updates = append(updates, firestore.Update{FieldPath: firestore.FieldPath{k}, Value: v})
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			updates = append(updates, firestore.Update{FieldPath: firestore.FieldPath{k}, Value: firestore.Delete})
+		}
+	}
+	return updates
+}
+
+// mergeUpdates returns the updates of the leaf fields of the map the same way as firestore.MergeAll
+func mergeUpdates(path firestore.FieldPath, m map[string]interface{}) []firestore.Update {
+	var updates []firestore.Update
+	for k, v := range m {
+		fp := append(append(firestore.FieldPath{}, path...), k)
+		if nested, ok := v.(map[string]interface{}); ok && len(nested) > 0 {
+			updates = append(updates, mergeUpdates(fp, nested)...)
+		} else {
+			updates = append(updates, firestore.Update{FieldPath: fp, Value: v})
+		}
+	}
+	return updates
+}
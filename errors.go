@@ -3,6 +3,9 @@ package firestorm
 import (
 	"cloud.google.com/go/firestore"
 	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
 )
 
 // NotFoundError is returned when any of the entities are not found in firestore
@@ -19,3 +22,171 @@ func newNotFoundError(refs map[string]*firestore.DocumentRef) NotFoundError {
 func (e NotFoundError) Error() string {
 	return fmt.Sprintf("Not found error %v", e.Refs)
 }
+
+// AlreadyExistsError is returned when creating an entity that already exists in firestore
+type AlreadyExistsError struct {
+	// Ref is the reference to the existing entity. It is nil if firestore does not tell which entity
+	// eg. when the error is returned by a batch or a transaction
+	Ref *firestore.DocumentRef
+	// Entity is the entity that could not be created
+	Entity interface{}
+	// Err is the underlying gRPC status error
+	Err error
+}
+
+func (e AlreadyExistsError) Error() string {
+	return fmt.Sprintf("Already exists error %v: %v", refPath(e.Ref), e.Err)
+}
+
+// Unwrap returns the underlying gRPC status error
+func (e AlreadyExistsError) Unwrap() error {
+	return e.Err
+}
+
+// ConflictError is returned when a precondition of a write fails. Eg. when the entity
+// has been modified since it was read
+type ConflictError struct {
+	// Ref is the reference to the entity. It is nil if firestore does not tell which entity
+	Ref *firestore.DocumentRef
+	// Entity is the entity that could not be written
+	Entity interface{}
+	// Err is the underlying error
+	Err error
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("Conflict error %v: %v", refPath(e.Ref), e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// TransactionAbortedError is returned by DoInTransaction when firestore aborts the transaction
+// eg. due to contention and the retries are exhausted
+type TransactionAbortedError struct {
+	// Err is the underlying gRPC status error
+	Err error
+}
+
+func (e TransactionAbortedError) Error() string {
+	return fmt.Sprintf("Transaction aborted error: %v", e.Err)
+}
+
+// Unwrap returns the underlying gRPC status error
+func (e TransactionAbortedError) Unwrap() error {
+	return e.Err
+}
+
+// toTypedError converts the gRPC status errors returned by firestore for writes to the typed errors. A failed
+// precondition is only a conflict if the writes had preconditions. Other errors are returned as is.
+func toTypedError(err error, ref *firestore.DocumentRef, entity interface{}, precondition bool) error {
+	switch status.Code(err) {
+	case codes.NotFound:
+		if ref != nil {
+			return newNotFoundError(map[string]*firestore.DocumentRef{ref.Path: ref})
+		}
+	case codes.AlreadyExists:
+		return AlreadyExistsError{Ref: ref, Entity: entity, Err: err}
+	case codes.FailedPrecondition:
+		if precondition {
+			return ConflictError{Ref: ref, Entity: entity, Err: err}
+		}
+	}
+	return err
+}
+
+// toTransactionError converts the error of beginning or committing a transaction to the typed errors
+func toTransactionError(err error, precondition bool) error {
+	if status.Code(err) == codes.Aborted {
+		return TransactionAbortedError{Err: err}
+	}
+	return toTypedError(err, nil, nil, precondition)
+}
+
+func refPath(ref *firestore.DocumentRef) string {
+	if ref == nil {
+		return "<unknown>"
+	}
+	return ref.Path
+}
+
+// EntityError is the error of a single entity in an operation on multiple entities
+type EntityError struct {
+	// Index is the index of the entity in the supplied slice or in the query result.
+	// It is -1 for a referenced entity written by a cascade
+	Index int
+	// Entity is the entity that failed. It is nil if the entity could not be created eg. in a query
+	Entity interface{}
+	// Ref is the reference to the entity. It is nil if the reference could not be created
+	Ref *firestore.DocumentRef
+	// Err is the underlying error eg. a gRPC status error
+	Err error
+}
+
+func (e EntityError) Error() string {
+	if e.Ref == nil {
+		return fmt.Sprintf("entity %d: %v", e.Index, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Ref.Path, e.Err)
+}
+
+// Unwrap returns the underlying error so it can be checked with errors.Is and errors.As
+func (e EntityError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned when some of the entities in an operation on multiple entities fail.
+// The entities not listed succeeded.
+type MultiError struct {
+	Errors []EntityError
+}
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the entity errors so they can be checked with errors.Is and errors.As
+func (e MultiError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Entities returns the entities that failed. Use it to retry the failed entities
+func (e MultiError) Entities() []interface{} {
+	result := make([]interface{}, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		if err.Entity != nil {
+			result = append(result, err.Entity)
+		}
+	}
+	return result
+}
+
+func multiErrorOrNil(errs []EntityError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return MultiError{errs}
+}
+
+// isAmbiguousError checks if the error leaves it unknown whether the write was committed eg. when the connection is
+// lost or the deadline is exceeded before firestore responds
+func isAmbiguousError(err error) bool {
+	if isContextError(err) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
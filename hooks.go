@@ -0,0 +1,73 @@
+package firestorm
+
+import (
+	"context"
+)
+
+// BeforeSaver is implemented by entities that need to run code before they are created or updated.
+// Eg. to set defaults, normalize fields or validate. An error aborts the write.
+type BeforeSaver interface {
+	BeforeSave(ctx context.Context) error
+}
+
+// BeforeCreator is implemented by entities that need to run code before they are created.
+// It is called after BeforeSave. An error aborts the write.
+type BeforeCreator interface {
+	BeforeCreate(ctx context.Context) error
+}
+
+// BeforeUpdater is implemented by entities that need to run code before they are updated.
+// It is called after BeforeSave. An error aborts the write.
+type BeforeUpdater interface {
+	BeforeUpdate(ctx context.Context) error
+}
+
+// BeforeDeleter is implemented by entities that need to run code before they are deleted.
+// An error aborts the delete.
+type BeforeDeleter interface {
+	BeforeDelete(ctx context.Context) error
+}
+
+// AfterLoader is implemented by entities that need to run code after they are loaded by a get or a query.
+// The referenced entities that are auto loaded are not called. An error is returned for the entity.
+type AfterLoader interface {
+	AfterLoad(ctx context.Context) error
+}
+
+func beforeCreate(ctx context.Context, entity interface{}) error {
+	if h, ok := entity.(BeforeSaver); ok {
+		if err := h.BeforeSave(ctx); err != nil {
+			return err
+		}
+	}
+	if h, ok := entity.(BeforeCreator); ok {
+		return h.BeforeCreate(ctx)
+	}
+	return nil
+}
+
+func beforeUpdate(ctx context.Context, entity interface{}) error {
+	if h, ok := entity.(BeforeSaver); ok {
+		if err := h.BeforeSave(ctx); err != nil {
+			return err
+		}
+	}
+	if h, ok := entity.(BeforeUpdater); ok {
+		return h.BeforeUpdate(ctx)
+	}
+	return nil
+}
+
+func beforeDelete(ctx context.Context, entity interface{}) error {
+	if h, ok := entity.(BeforeDeleter); ok {
+		return h.BeforeDelete(ctx)
+	}
+	return nil
+}
+
+func afterLoad(ctx context.Context, entity interface{}) error {
+	if h, ok := entity.(AfterLoader); ok {
+		return h.AfterLoad(ctx)
+	}
+	return nil
+}
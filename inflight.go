@@ -0,0 +1,131 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+// inflight tracks the documents being read from firestore so concurrent reads of the same document
+// share a single read
+type inflight struct {
+	sync.Mutex
+	calls map[string]*loadCall
+}
+
+type loadCall struct {
+	done chan struct{}
+	doc  *firestore.DocumentSnapshot
+	err  error
+}
+
+// start registers the calls for the paths not already being read. The calls owned by the caller must be finished
+// with finish. The shared calls are finished by the caller that owns them
+func (f *inflight) start(refs []*firestore.DocumentRef) (calls []*loadCall, owned []bool) {
+	f.Lock()
+	defer f.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[string]*loadCall)
+	}
+	calls = make([]*loadCall, len(refs))
+	owned = make([]bool, len(refs))
+	for i, ref := range refs {
+		if c, ok := f.calls[ref.Path]; ok {
+			calls[i] = c
+			continue
+		}
+		calls[i] = &loadCall{done: make(chan struct{})}
+		owned[i] = true
+		f.calls[ref.Path] = calls[i]
+	}
+	return calls, owned
+}
+
+func (f *inflight) finish(path string, c *loadCall, doc *firestore.DocumentSnapshot, err error) {
+	f.Lock()
+	delete(f.calls, path)
+	f.Unlock()
+	c.doc, c.err = doc, err
+	close(c.done)
+}
+
+// loadDocs reads the documents from firestore. Documents that are already being read by another request are not
+// read again but shared. Shared is true for the documents read by another request. If the read of another request fails
+// because its context ended the documents are read again with ctx. Transactions always read the documents themselves
+func (fsc *FSClient) loadDocs(ctx context.Context, refs []*firestore.DocumentRef) (docs []*firestore.DocumentSnapshot, shared []bool, err error) {
+	if _, ok := getTransaction(ctx); ok {
+		docs, err = getAll(ctx, fsc.Client, refs)
+		return docs, make([]bool, len(docs)), err
+	}
+
+	calls, owned := fsc.loads.start(refs)
+	load := make([]*firestore.DocumentRef, 0, len(refs))
+	for i, ref := range refs {
+		if owned[i] {
+			load = append(load, ref)
+		}
+	}
+	loaded, err := getAll(ctx, fsc.Client, load)
+	j := 0
+	for i, ref := range refs {
+		if !owned[i] {
+			continue
+		}
+		var doc *firestore.DocumentSnapshot
+		if err == nil {
+			doc = loaded[j]
+		}
+		fsc.loads.finish(ref.Path, calls[i], doc, err)
+		j++
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	docs = make([]*firestore.DocumentSnapshot, len(refs))
+	shared = make([]bool, len(refs))
+	var retry []int
+	for i, c := range calls {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if c.err != nil && isContextError(c.err) {
+			// the context of the request owning the read ended so the document is read with our own context
+			retry = append(retry, i)
+			continue
+		}
+		if c.err != nil {
+			return nil, nil, c.err
+		}
+		docs[i] = c.doc
+		shared[i] = !owned[i]
+	}
+	if len(retry) > 0 {
+		retryRefs := make([]*firestore.DocumentRef, len(retry))
+		for j, i := range retry {
+			retryRefs[j] = refs[i]
+		}
+		retryDocs, retryShared, err := fsc.loadDocs(ctx, retryRefs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, i := range retry {
+			docs[i], shared[i] = retryDocs[j], retryShared[j]
+		}
+	}
+	return docs, shared, nil
+}
+
+// isContextError checks if the error is caused by a cancelled context or an exceeded deadline
+func isContextError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	code := status.Code(err)
+	return code == codes.Canceled || code == codes.DeadlineExceeded
+}
@@ -0,0 +1,75 @@
+package firestorm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Invalidation is broadcast on the InvalidationBus when entities are written or deleted
+type Invalidation struct {
+	// Source identifies the client that published the invalidation so it can ignore its own invalidations
+	Source string `json:"source"`
+	// Keys are the paths of the written or deleted entities
+	Keys []string `json:"keys"`
+}
+
+// InvalidationBus broadcasts the invalidations between the instances of an application so entities written on one
+// instance are evicted from the second level caches of the others. Use it when the second level cache is local to each
+// instance eg. cache.InMemoryCache. See cache.LocalBus and the redis package for implementations
+type InvalidationBus interface {
+	// Publish sends the invalidation to all subscribers
+	Publish(ctx context.Context, inv Invalidation) error
+	// Subscribe calls the handler with the published invalidations until the context is done. It returns when the
+	// subscription is ready so invalidations published afterwards are received
+	Subscribe(ctx context.Context, handler func(inv Invalidation)) error
+}
+
+// SetInvalidationBus publishes the keys written or deleted by this client on the bus and evicts the keys published by
+// other clients from the second level cache and the cached queries. The subscription ends when the context is done
+func (fsc *FSClient) SetInvalidationBus(ctx context.Context, bus InvalidationBus) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	source := hex.EncodeToString(id)
+	err := bus.Subscribe(ctx, func(inv Invalidation) {
+		if inv.Source == source {
+			return
+		}
+		if err := fsc.Cache.deleteSecondMulti(ctx, inv.Keys); err != nil {
+			fsc.log(ctx, LevelError, "Could not evict invalidated keys from cache", "op", "invalidate", "paths", inv.Keys, "err", err)
+		}
+		fsc.queries.invalidate(inv.Keys...)
+	})
+	if err != nil {
+		return err
+	}
+	fsc.Cache.bus, fsc.Cache.source = bus, source
+	return nil
+}
+
+// publish broadcasts the written or deleted keys to the other clients
+func (c *cacheWrapper) publish(ctx context.Context, keys []string) error {
+	if c.bus == nil || len(keys) == 0 {
+		return nil
+	}
+	return c.bus.Publish(ctx, Invalidation{Source: c.source, Keys: keys})
+}
+
+// invalidate invalidates the cached queries of the collections of the written documents and publishes the paths
+// to the other clients. In a transaction it is done when the transaction is committed
+func (fsc *FSClient) invalidate(ctx context.Context, paths []string) {
+	if c, ok := fsc.getCache(ctx).first.(*defaultCache); ok && c.written != nil {
+		c.recordWritten(paths)
+		return
+	}
+	fsc.invalidateCommitted(ctx, paths)
+}
+
+func (fsc *FSClient) invalidateCommitted(ctx context.Context, paths []string) {
+	fsc.queries.invalidate(paths...)
+	if err := fsc.Cache.publish(ctx, paths); err != nil {
+		fsc.log(ctx, LevelError, "Could not publish invalidated keys", "op", "invalidate", "paths", paths, "err", err)
+	}
+}
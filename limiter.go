@@ -0,0 +1,84 @@
+package firestorm
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter is a semaphore capping the number of operations in flight. A nil limiter is unbounded.
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(limiter, n)
+}
+
+// acquire blocks until a slot is free or the context is done
+func (l limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+type limits struct {
+	sync.RWMutex
+	reads, writes limiter
+}
+
+func (l *limits) get() (reads, writes limiter) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.reads, l.writes
+}
+
+// SetConcurrency caps the number of reads and writes that are sent to firestore concurrently.
+// Requests exceeding the limits block until a slot is free or their context is done.
+// Use zero for no limit which is the default.
+func (fsc *FSClient) SetConcurrency(reads, writes int) {
+	fsc.limits.Lock()
+	defer fsc.limits.Unlock()
+	fsc.limits.reads = newLimiter(reads)
+	fsc.limits.writes = newLimiter(writes)
+}
+
+// runRead runs the read operation async when a read slot is available
+func (fsc *FSClient) runRead(ctx context.Context, fun asyncFunc) FutureFunc {
+	reads, _ := fsc.limits.get()
+	return runLimited(ctx, reads, fun)
+}
+
+// runWrite runs the write operation async when a write slot is available
+func (fsc *FSClient) runWrite(ctx context.Context, fun asyncFunc) FutureFunc {
+	_, writes := fsc.limits.get()
+	return runLimited(ctx, writes, fun)
+}
+
+// runLimited blocks until a slot is available and runs the operation async in it. Acquiring the slot before the go
+// routine is started keeps the number of go routines bounded by the limit as well
+func runLimited(ctx context.Context, l limiter, fun asyncFunc) FutureFunc {
+	if _, ok := getTransaction(ctx); ok {
+		// transactions run sequentially so there is nothing to limit
+		return runAsync(ctx, fun)
+	}
+	if err := l.acquire(ctx); err != nil {
+		return func() error { return err }
+	}
+	return runAsync(ctx, func() error {
+		defer l.release()
+		return fun()
+	})
+}
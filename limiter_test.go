@@ -0,0 +1,49 @@
+package firestorm
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunLimited(t *testing.T) {
+	ctx := context.Background()
+	l := newLimiter(2)
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+
+	futures := make([]FutureFunc, 10)
+	for i := range futures {
+		futures[i] = runLimited(ctx, l, func() error {
+			mu.Lock()
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil
+		})
+	}
+	for _, future := range futures {
+		if err := future(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peak > 2 {
+		t.Errorf("the operations in flight should be limited to 2: %d", peak)
+	}
+
+	// operations waiting for a slot fail when the context is done
+	l <- struct{}{}
+	l <- struct{}{}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := runLimited(cancelCtx, l, func() error { return nil })(); err != context.Canceled {
+		t.Errorf("the cancelled context should fail the operation: %v", err)
+	}
+}
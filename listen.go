@@ -0,0 +1,241 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"reflect"
+	"sync"
+)
+
+// ChangeKind is the kind of change of an entity reported by a listener
+type ChangeKind int
+
+const (
+	// EntityAdded the entity was added for the first time
+	EntityAdded ChangeKind = iota
+	// EntityModified the entity was modified
+	EntityModified
+	// EntityRemoved the entity was removed. It has been deleted or no longer matches the query
+	EntityRemoved
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case EntityAdded:
+		return "added"
+	case EntityModified:
+		return "modified"
+	case EntityRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// Change is a change of an entity reported by a listener. A removed entity only has its id set. The entity and the
+// result are new values for each change so they can be kept after the callback returns.
+type Change struct {
+	Kind   ChangeKind
+	Entity interface{}
+	Ref    *firestore.DocumentRef
+	// Result is a slice of the type given to ListenQuery with the current query result in order. Nil for ListenEntity
+	Result interface{}
+}
+
+// ListenFunc is called with the changes each time the listened entities change. Returning an error stops the listener.
+type ListenFunc func(changes []Change) error
+
+// listenEntity listens for changes of the document of the entity and maps them to new entities of the same type
+func (fsc *FSClient) listenEntity(ctx context.Context, req *Request, entity interface{}, callback ListenFunc) FutureFunc {
+	ref := req.ToRef(entity)
+	it := ref.Snapshots(ctx)
+	deletedAt, softDelete := fsc.deletedAtKey(reflect.TypeOf(entity))
+	exists := false
+
+	next := func() error {
+		doc, err := it.Next()
+		if err != nil {
+			return err
+		}
+		if !doc.Exists() {
+			fsc.updateListenCache(ctx, nil, []string{ref.Path})
+		} else {
+			fsc.updateListenCache(ctx, []*firestore.DocumentSnapshot{doc}, nil)
+		}
+
+		var m entityMap
+		if doc.Exists() {
+			// dangling references are not loaded but the listener continues as in GetEntities
+			res, err := newResolver(fsc, req.loadPaths...).ResolveDocs(ctx, []*firestore.DocumentSnapshot{doc})
+			if _, ok := err.(NotFoundError); err != nil && !ok {
+				return err
+			}
+			m = res[0]
+		}
+		if softDelete && !req.includeDeleted && isDeleted(m, deletedAt) {
+			m = nil
+		}
+
+		var change Change
+		switch {
+		case m == nil && !exists:
+			return nil
+		case m == nil:
+			exists = false
+			p := reflect.New(getStructType(entity))
+			req.SetID(p.Interface(), ref.ID)
+			change = Change{Kind: EntityRemoved, Entity: p.Interface(), Ref: ref}
+		default:
+			// the entity of the caller is not modified as the listener runs in another go routine
+			p, err := fsc.toEntity(ctx, m, reflect.TypeOf(entity))
+			if err != nil {
+				return err
+			}
+			change = Change{Kind: EntityModified, Entity: p.Interface(), Ref: ref}
+			if !exists {
+				change.Kind = EntityAdded
+			}
+			exists = true
+		}
+		return callback([]Change{change})
+	}
+	return listen(ctx, it.Stop, next)
+}
+
+// listenQuery listens for changes of the query result and maps them to new entities of the slice element type.
+// The slice of the caller is not modified as the listener runs in another go routine. A new slice with the current
+// result is passed in the changes instead.
+func (fsc *FSClient) listenQuery(ctx context.Context, req *Request, q firestore.Query, toSlicePtr interface{}, callback ListenFunc) FutureFunc {
+	it := fsc.withoutDeletedQuery(req, q, toSlicePtr).Snapshots(ctx)
+	sliceType := reflect.TypeOf(toSlicePtr).Elem()
+	elemType := sliceType.Elem()
+	deletedAt, softDelete := fsc.deletedAtKey(elemType)
+	softDelete = softDelete && !req.includeDeleted
+	visible := make(map[string]bool) // the paths of the documents reported to the callback
+	current := make(map[string]reflect.Value)
+
+	next := func() error {
+		snap, err := it.Next()
+		if err != nil {
+			return err
+		}
+		docs := make([]*firestore.DocumentSnapshot, 0, len(snap.Changes))
+		var removed []string
+		for _, c := range snap.Changes {
+			if c.Kind == firestore.DocumentRemoved {
+				removed = append(removed, c.Doc.Ref.Path)
+			} else {
+				docs = append(docs, c.Doc)
+			}
+		}
+		fsc.updateListenCache(ctx, docs, removed)
+
+		// dangling references are not loaded but the listener continues as in GetEntities
+		res, err := newResolver(fsc, req.loadPaths...).ResolveDocs(ctx, docs)
+		if _, ok := err.(NotFoundError); err != nil && !ok {
+			return err
+		}
+
+		changes := make([]Change, 0, len(snap.Changes))
+		i := 0
+		for _, c := range snap.Changes {
+			path := c.Doc.Ref.Path
+			var m entityMap
+			if c.Kind != firestore.DocumentRemoved {
+				m = res[i]
+				i++
+			}
+			if softDelete && isDeleted(m, deletedAt) {
+				m = nil
+			}
+			if m == nil {
+				if visible[path] {
+					p := reflect.New(baseType(elemType))
+					req.SetID(p.Interface(), c.Doc.Ref.ID)
+					changes = append(changes, Change{Kind: EntityRemoved, Entity: p.Interface(), Ref: c.Doc.Ref})
+				}
+				delete(visible, path)
+				delete(current, path)
+				continue
+			}
+			p, err := fsc.toEntity(ctx, m, elemType)
+			if err != nil {
+				return err
+			}
+			kind := EntityModified
+			if !visible[path] {
+				kind = EntityAdded
+			}
+			visible[path] = true
+			current[path] = p
+			changes = append(changes, Change{Kind: kind, Entity: p.Interface(), Ref: c.Doc.Ref})
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		// keep the order of the query result
+		var order []string
+		iter := snap.Documents
+		for {
+			doc, err := iter.Next()
+			if err != nil {
+				break
+			}
+			order = append(order, doc.Ref.Path)
+		}
+		result := reflect.MakeSlice(sliceType, 0, len(current))
+		for _, path := range order {
+			if p, ok := current[path]; ok {
+				result = reflect.Append(result, p)
+			}
+		}
+		for i := range changes {
+			changes[i].Result = result.Interface()
+		}
+		return callback(changes)
+	}
+	return listen(ctx, it.Stop, next)
+}
+
+// updateListenCache updates the second level cache with the changed documents. The session cache is not
+// used as listeners live longer than a session.
+func (fsc *FSClient) updateListenCache(ctx context.Context, docs []*firestore.DocumentSnapshot, removed []string) {
+	multi := make(map[string]EntityMap, len(docs))
+	for _, doc := range docs {
+		multi[doc.Ref.Path] = withMetadata(doc.Data(), docMetadata(doc))
+	}
+	if err := fsc.Cache.setSecondMulti(ctx, multi); err != nil {
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "listen", "paths", mapKeys(multi), "err", err)
+	}
+	if err := fsc.Cache.deleteSecondMulti(ctx, removed); err != nil {
+		fsc.log(ctx, LevelError, "Cache error but continue", "op", "listen", "paths", removed, "err", err)
+	}
+	for path := range multi {
+		removed = append(removed, path)
+	}
+	fsc.queries.invalidate(removed...)
+}
+
+// listen calls next until it fails or the context is done and stops the listener. The returned func blocks until
+// the listener is stopped. It returns nil if the listener was stopped by the context.
+func listen(ctx context.Context, stop func(), next func() error) FutureFunc {
+	var err error
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		defer stop()
+		for err == nil {
+			err = next()
+		}
+		if ctx.Err() != nil {
+			err = nil
+		}
+	}()
+
+	return func() error {
+		wg.Wait()
+		return err
+	}
+}
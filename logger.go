@@ -0,0 +1,81 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"log/slog"
+)
+
+// LogLevel is the level of a log message. The levels have the same values as the slog levels
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	return slog.Level(l).String()
+}
+
+// Logger logs the messages of firestorm eg. cache errors. The fields are alternating keys and values like in slog.
+// The keys used are "op" for the operation, "path" and "paths" for the document paths and "err" for the error.
+// Implement it to use another logging library eg. zap
+type Logger interface {
+	Log(ctx context.Context, level LogLevel, msg string, fields ...interface{})
+}
+
+// NewSlogLogger creates a Logger logging to the slog logger. If the logger is nil the messages are logged to
+// slog.Default() at the time of logging so a later slog.SetDefault is respected
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l *slogLogger) Log(ctx context.Context, level LogLevel, msg string, fields ...interface{}) {
+	logger := l.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Log(ctx, slog.Level(level), msg, fields...)
+}
+
+// log logs the message with the logger of the client. Nothing is logged if the logger is nil
+func (fsc *FSClient) log(ctx context.Context, level LogLevel, msg string, fields ...interface{}) {
+	if fsc.Logger != nil {
+		fsc.Logger.Log(ctx, level, msg, fields...)
+	}
+}
+
+// warnNoSessionCache warns once if the context has no session cache
+func (fsc *FSClient) warnNoSessionCache(ctx context.Context) {
+	if _, ok := ctx.Value(SessionCacheKey).(map[string]EntityMap); ok {
+		return
+	}
+	fsc.sessionWarning.Do(func() {
+		fsc.log(ctx, LevelWarn, "Consider adding the CacheHandler middleware for the session cache to work")
+	})
+}
+
+// refPaths returns the paths of the refs for logging
+func refPaths(refs []*firestore.DocumentRef) []string {
+	paths := make([]string, len(refs))
+	for i, ref := range refs {
+		paths[i] = ref.Path
+	}
+	return paths
+}
+
+// mapKeys returns the paths of the entities for logging
+func mapKeys(m map[string]EntityMap) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,24 @@
+package firestorm
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestDefaultLogger(t *testing.T) {
+	fsc := New(nil, "ID", "")
+
+	// the default logger is set after the client is created
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	fsc.log(context.Background(), LevelWarn, "late default", "op", "test")
+	if out := buf.String(); !strings.Contains(out, "late default") || !strings.Contains(out, "op=test") {
+		t.Errorf("the message should have been logged to the current default logger: %q", out)
+	}
+}
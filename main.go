@@ -4,6 +4,8 @@ import (
 	"cloud.google.com/go/firestore"
 	"context"
 	mapper "github.com/jschoedt/go-structmapper"
+	"sync"
+	"time"
 )
 
 // FSClient is the client used to perform the CRUD actions
@@ -14,6 +16,26 @@ type FSClient struct {
 	IDKey, ParentKey string
 	Cache            *cacheWrapper
 	IsEntity         func(i interface{}) bool
+	// CreateTimeKey, UpdateTimeKey and ReadTimeKey are the names of the time.Time fields that receive the
+	// create, update and read times of the documents. The fields are not saved. Leave blank if not used
+	CreateTimeKey, UpdateTimeKey, ReadTimeKey string
+	// DeletedAtKey is the name of the time.Time or *time.Time field used for soft delete. Entities with the field are
+	// stamped with the delete time instead of being deleted and are left out of gets and queries. The field is saved as
+	// null when the entity is not deleted so queries filter on it in firestore. Leave blank if not used
+	DeletedAtKey string
+	// DirtyTracking makes UpdateEntities write only the fields changed since the entity was loaded
+	// in the session and skip the write if nothing changed. Requires the session cache. See CacheHandler
+	DirtyTracking bool
+	// OptimisticLocking makes updates and deletes fail with a ConflictError if the document has been
+	// modified since the entity was loaded in the session. Requires the session cache. See CacheHandler
+	OptimisticLocking bool
+	// Logger logs the cache errors and warnings. It defaults to the slog.Default() at the time of logging.
+	// Set it to nil to disable logging
+	Logger         Logger
+	limits         limits
+	loads          inflight
+	queries        queryCache
+	sessionWarning sync.Once
 }
 
 // NewRequest creates a new CRUD Request to firestore
@@ -27,7 +49,8 @@ func (fsc *FSClient) NewRequest() *Request {
 }
 
 // New creates a firestorm client. Supply the names of the id and parent fields of your model structs
-// Leave parent blank if sub-collections are not used.
+// Leave parent blank if sub-collections are not used. The fields can also be marked with the
+// `firestorm:"id"` and `firestorm:"parent"` struct tags which take precedence over the names. See TagName
 func New(client *firestore.Client, id, parent string) *FSClient {
 	c := &FSClient{}
 	c.Client = client
@@ -40,12 +63,16 @@ func New(client *firestore.Client, id, parent string) *FSClient {
 	c.ParentKey = parent
 	c.Cache = newCacheWrapper(client, newDefaultCache(), nil)
 	c.IsEntity = isEntity(c.IDKey)
+	c.Logger = NewSlogLogger(nil)
 	return c
 }
 
 // SetCache sets a second level cache besides the session cache. Use it for eg. memcache or redis
 func (fsc *FSClient) SetCache(cache Cache) {
-	fsc.Cache = newCacheWrapper(fsc.Client, newDefaultCache(), cache)
+	// keep the policies, the invalidation bus and the statistics
+	cw := *fsc.Cache
+	cw.first, cw.second = newDefaultCache(), cache
+	fsc.Cache = &cw
 }
 
 // getCache gets the transaction cache when inside a transaction - otherwise the global cache
@@ -56,6 +83,18 @@ func (fsc *FSClient) getCache(ctx context.Context) *cacheWrapper {
 	return fsc.Cache
 }
 
+// getSnapshot gets the entity as it was last loaded or written in the session and the update time of the document.
+// Inside a transaction the session the transaction was started from is used if the entity is not in the transaction
+func (fsc *FSClient) getSnapshot(ctx context.Context, ref *firestore.DocumentRef) (EntityMap, time.Time) {
+	m, updateTime := fsc.getCache(ctx).snapshot(ctx, ref)
+	if m == nil {
+		if outer, ok := ctx.Value(outerCtxKey).(context.Context); ok {
+			return fsc.getSnapshot(outer, ref)
+		}
+	}
+	return m, updateTime
+}
+
 // isEntity tests if the i is a firestore entity
 func isEntity(id string) func(i interface{}) bool {
 	return func(i interface{}) bool {
@@ -1,8 +1,8 @@
 package firestorm
 
 import (
+	"cloud.google.com/go/firestore"
 	"context"
-	"errors"
 	mapper "github.com/jschoedt/go-structmapper"
 	"reflect"
 	"strings"
@@ -67,23 +67,20 @@ func (fsc *FSClient) DefaultFromDBMapperFunc(inKey string, inVal interface{}) (m
 	return mapper.NilMapFunc(strings.Title(inKey), inVal)
 }
 
-func (fsc *FSClient) toEntities(ctx context.Context, entities []entityMap, toSlicePtr interface{}) error {
-	var errs []string
+func (fsc *FSClient) toEntities(ctx context.Context, refs []*firestore.DocumentRef, entities []entityMap, toSlicePtr interface{}) error {
+	var errs []EntityError
 	valuePtr := reflect.ValueOf(toSlicePtr)
 	value := reflect.Indirect(valuePtr)
-	for _, m := range entities {
+	for i, m := range entities {
 		// log.Printf("type %v", value.Type().Elem())
 		if p, err := fsc.toEntity(ctx, m, value.Type().Elem()); err != nil {
-			errs = append(errs, err.Error())
+			errs = append(errs, EntityError{Index: i, Entity: p.Interface(), Ref: refs[i], Err: err})
 			continue
 		} else {
 			value.Set(reflect.Append(value, p))
 		}
 	}
-	if len(errs) > 0 {
-		return errors.New(strings.Join(errs, "\n"))
-	}
-	return nil
+	return multiErrorOrNil(errs)
 }
 
 func (fsc *FSClient) toEntity(ctx context.Context, m map[string]interface{}, typ reflect.Type) (reflect.Value, error) {
@@ -93,7 +90,10 @@ func (fsc *FSClient) toEntity(ctx context.Context, m map[string]interface{}, typ
 	}
 
 	p := reflect.New(typ)
-	err := fsc.MapFromDB.MapToStruct(m, p.Interface())
+	err := fsc.fromDB(m, p.Interface())
+	if err == nil {
+		err = afterLoad(ctx, p.Interface())
+	}
 
 	if isPtr {
 		return p, err
@@ -0,0 +1,102 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"reflect"
+	"time"
+)
+
+// the keys of the document metadata in the cached entities
+const (
+	createTimeKey = "_createTime"
+	updateTimeKey = "_updateTime"
+	readTimeKey   = "_readTime"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// metadata is the metadata of a document. A zero time is not known
+type metadata struct {
+	createTime, updateTime, readTime time.Time
+}
+
+func docMetadata(doc *firestore.DocumentSnapshot) metadata {
+	return metadata{doc.CreateTime, doc.UpdateTime, doc.ReadTime}
+}
+
+// withMetadata adds the metadata of the document to the entity map so it is cached along with the entity
+func withMetadata(m map[string]interface{}, md metadata) map[string]interface{} {
+	if m == nil {
+		return m // not found
+	}
+	setTime(m, createTimeKey, md.createTime)
+	setTime(m, updateTimeKey, md.updateTime)
+	setTime(m, readTimeKey, md.readTime)
+	return m
+}
+
+// setTime sets the time in the map. A zero time removes it
+func setTime(m map[string]interface{}, key string, t time.Time) {
+	if t.IsZero() {
+		delete(m, key)
+	} else {
+		m[key] = t
+	}
+}
+
+// popMetadata removes the metadata from the entity map and returns it
+func popMetadata(m map[string]interface{}) metadata {
+	var md metadata
+	md.createTime, _ = m[createTimeKey].(time.Time)
+	md.updateTime, _ = m[updateTimeKey].(time.Time)
+	md.readTime, _ = m[readTimeKey].(time.Time)
+	delete(m, createTimeKey)
+	delete(m, updateTimeKey)
+	delete(m, readTimeKey)
+	return md
+}
+
+// toMetadataKeys moves the metadata in the entity map to the metadata keys of the client so they are
+// mapped to the metadata fields of the entity the same way as the id
+func (fsc *FSClient) toMetadataKeys(m map[string]interface{}) {
+	md := popMetadata(m)
+	for key, t := range fsc.metadataKeys(md) {
+		if !t.IsZero() {
+			m[key] = t
+		}
+	}
+}
+
+// metadataKeys maps the configured metadata keys of the client to the times
+func (fsc *FSClient) metadataKeys(md metadata) map[string]time.Time {
+	result := make(map[string]time.Time, 3)
+	if fsc.CreateTimeKey != "" {
+		result[fsc.CreateTimeKey] = md.createTime
+	}
+	if fsc.UpdateTimeKey != "" {
+		result[fsc.UpdateTimeKey] = md.updateTime
+	}
+	if fsc.ReadTimeKey != "" {
+		result[fsc.ReadTimeKey] = md.readTime
+	}
+	return result
+}
+
+// removeMetadataFields removes the metadata fields of the entity from the map saved to firestore
+func (fsc *FSClient) removeMetadataFields(m map[string]interface{}) {
+	for key := range fsc.metadataKeys(metadata{}) {
+		delete(m, fsc.mappedKey(key))
+	}
+}
+
+// setMetadataFields sets the known times on the metadata fields of the entity
+func (fsc *FSClient) setMetadataFields(entity interface{}, md metadata) {
+	for key, t := range fsc.metadataKeys(md) {
+		if t.IsZero() {
+			continue
+		}
+		if f, ok := getKeyValue(key, "", entity); ok && f.CanSet() && f.Type() == timeType {
+			f.Set(reflect.ValueOf(t))
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"crypto/sha256"
+	"encoding/hex"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// queryCache caches the paths of the documents returned by queries. The cached queries of a collection are
+// invalidated when a document in the collection is written
+type queryCache struct {
+	sync.Mutex
+	collections map[string]*cachedQueries
+}
+
+type cachedQueries struct {
+	generation int // incremented when the collection is invalidated
+	queries    map[string]cachedQuery
+}
+
+type cachedQuery struct {
+	paths   []string
+	expires time.Time
+}
+
+func (c *queryCache) collection(id string) *cachedQueries {
+	if c.collections == nil {
+		c.collections = make(map[string]*cachedQueries)
+	}
+	cq, ok := c.collections[id]
+	if !ok {
+		cq = &cachedQueries{queries: make(map[string]cachedQuery)}
+		c.collections[id] = cq
+	}
+	return cq
+}
+
+// get returns the cached paths of the query and the generation of the collection. The generation must be given
+// to set so results of queries running while the collection is invalidated are not cached
+func (c *queryCache) get(collection, key string) ([]string, int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cq := c.collection(collection)
+	q, ok := cq.queries[key]
+	if !ok || time.Now().After(q.expires) {
+		delete(cq.queries, key)
+		return nil, cq.generation, false
+	}
+	return q.paths, cq.generation, true
+}
+
+func (c *queryCache) set(collection, key string, generation int, paths []string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	cq := c.collection(collection)
+	if cq.generation != generation {
+		return
+	}
+	now := time.Now()
+	for k, q := range cq.queries {
+		if now.After(q.expires) {
+			delete(cq.queries, k)
+		}
+	}
+	cq.queries[key] = cachedQuery{paths: paths, expires: now.Add(ttl)}
+}
+
+// invalidate removes the cached queries of the collections of the document paths
+func (c *queryCache) invalidate(paths ...string) {
+	if len(paths) == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, path := range paths {
+		cq := c.collection(collectionID(path))
+		cq.generation++
+		cq.queries = make(map[string]cachedQuery)
+	}
+}
+
+// queryKey returns the collection id of the query and a key made from the RunQueryRequest of the query marshalled
+// deterministically. False if the query has an error. The query is then not cached
+func queryKey(q firestore.Query) (string, string, bool) {
+	b, err := q.Serialize()
+	if err != nil {
+		return "", "", false
+	}
+	var req pb.RunQueryRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return "", "", false
+	}
+	from := req.GetStructuredQuery().GetFrom()
+	if len(from) != 1 || from[0].GetCollectionId() == "" {
+		return "", "", false
+	}
+	b, err = proto.MarshalOptions{Deterministic: true}.Marshal(&req)
+	if err != nil {
+		return "", "", false
+	}
+	collection := from[0].GetCollectionId()
+	sum := sha256.Sum256(b)
+	return collection, collection + "/" + hex.EncodeToString(sum[:]), true
+}
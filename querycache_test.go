@@ -0,0 +1,73 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"testing"
+)
+
+func TestQueryKey(t *testing.T) {
+	// the queries are only serialized so the emulator does not need to run
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	client, err := firestore.NewClient(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	cars := client.Collection("Car")
+
+	key := func(q firestore.Query) string {
+		collection, key, ok := queryKey(q)
+		if !ok || collection != "Car" {
+			t.Fatalf("the query should have a key in the Car collection: %v %v", collection, ok)
+		}
+		return key
+	}
+
+	// equal queries built in different ways share the key
+	base := key(cars.Where("make", "==", "Toyota").OrderBy("year", firestore.Desc).Limit(10))
+	equal := []firestore.Query{
+		cars.Query.Where("make", "==", "Toyota").OrderBy("year", firestore.Desc).Limit(10),
+		cars.Where("make", "==", "Toyota").Limit(5).OrderBy("year", firestore.Desc).Limit(10),
+		cars.WherePath(firestore.FieldPath{"make"}, "==", "Toyota").OrderByPath(firestore.FieldPath{"year"}, firestore.Desc).Limit(10),
+	}
+	for i, q := range equal {
+		if k := key(q); k != base {
+			t.Errorf("query %d should have the same key", i)
+		}
+	}
+
+	// different filters, orders and cursors have their own keys
+	different := []firestore.Query{
+		cars.Where("make", "==", "Jeep").OrderBy("year", firestore.Desc).Limit(10),
+		cars.Where("make", "!=", "Toyota").OrderBy("year", firestore.Desc).Limit(10),
+		cars.Where("make", "==", "Toyota").OrderBy("year", firestore.Asc).Limit(10),
+		cars.Where("make", "==", "Toyota").OrderBy("year", firestore.Desc).Limit(20),
+		cars.Where("make", "==", "Toyota").OrderBy("year", firestore.Desc).Limit(10).StartAt(2000),
+		cars.Where("make", "==", "Toyota").OrderBy("year", firestore.Desc).Limit(10).StartAfter(2000),
+		cars.Where("make", "==", "Toyota").OrderBy("year", firestore.Desc).Limit(10).EndAt(2000),
+		client.Collection("Garage").Doc("1").Collection("Car").Where("make", "==", "Toyota").OrderBy("year", firestore.Desc).Limit(10),
+	}
+	seen := map[string]int{base: -1}
+	for i, q := range different {
+		k := key(q)
+		if j, ok := seen[k]; ok {
+			t.Errorf("query %d should not have the same key as query %d", i, j)
+		}
+		seen[k] = i
+	}
+
+	// maps in the filter values are serialized in the same order
+	m := map[string]interface{}{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}
+	mapKey := key(cars.Where("owner", "==", m))
+	for i := 0; i < 10; i++ {
+		if k := key(cars.Where("owner", "==", m)); k != mapKey {
+			t.Errorf("queries with map values should have the same key")
+		}
+	}
+
+	// queries with errors are not cached
+	if _, _, ok := queryKey(cars.Where("make", "~", "Toyota")); ok {
+		t.Errorf("a query with an error should not be cached")
+	}
+}
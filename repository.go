@@ -0,0 +1,212 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Repository is a typed API on top of Request for entities of the struct type T. Eg.:
+//
+//	cars := firestorm.NewRepository[Car](fsc)
+//	car, err := cars.GetByID(ctx, "MyCar")()
+//
+// The repository is safe to share. Methods that configure the requests return a copy.
+type Repository[T any] struct {
+	fsc          *FSClient
+	loadPaths    []string
+	cascadePaths []string
+	mapperFunc   mapperFunc
+	atomic       bool
+	merge        bool
+	deleted      bool
+	queryTTL     time.Duration
+}
+
+// NewRepository creates a Repository for the entity type T. It panics if T is not a struct.
+func NewRepository[T any](fsc *FSClient) *Repository[T] {
+	if t := reflect.TypeOf((*T)(nil)).Elem(); t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("repository type must be a struct: %s", t))
+	}
+	return &Repository[T]{fsc: fsc}
+}
+
+// SetLoadPaths returns a copy of the repository loading the paths (refs). See Request.SetLoadPaths
+func (r *Repository[T]) SetLoadPaths(paths ...string) *Repository[T] {
+	c := *r
+	c.loadPaths = paths
+	return &c
+}
+
+// SetCascadePaths returns a copy of the repository writing the referenced entities on the paths. See Request.SetCascadePaths
+func (r *Repository[T]) SetCascadePaths(paths ...string) *Repository[T] {
+	c := *r
+	c.cascadePaths = paths
+	return &c
+}
+
+// SetMapperFunc returns a copy of the repository using the mapper func. See Request.SetMapperFunc
+func (r *Repository[T]) SetMapperFunc(mapperFunc mapperFunc) *Repository[T] {
+	c := *r
+	c.mapperFunc = mapperFunc
+	return &c
+}
+
+// SetAtomic returns a copy of the repository with atomic writes. See Request.SetAtomic
+func (r *Repository[T]) SetAtomic(atomic bool) *Repository[T] {
+	c := *r
+	c.atomic = atomic
+	return &c
+}
+
+// SetMerge returns a copy of the repository merging updates into the existing documents. See Request.SetMerge
+func (r *Repository[T]) SetMerge(merge bool) *Repository[T] {
+	c := *r
+	c.merge = merge
+	return &c
+}
+
+// IncludeDeleted returns a copy of the repository including the soft deleted entities. See Request.IncludeDeleted
+func (r *Repository[T]) IncludeDeleted() *Repository[T] {
+	c := *r
+	c.deleted = true
+	return &c
+}
+
+// SetQueryCache returns a copy of the repository caching the query results. See Request.SetQueryCache
+func (r *Repository[T]) SetQueryCache(ttl time.Duration) *Repository[T] {
+	c := *r
+	c.queryTTL = ttl
+	return &c
+}
+
+// NewRequest creates a Request configured as the repository
+func (r *Repository[T]) NewRequest() *Request {
+	req := r.fsc.NewRequest().SetLoadPaths(r.loadPaths...).SetCascadePaths(r.cascadePaths...).SetAtomic(r.atomic).SetMerge(r.merge).SetQueryCache(r.queryTTL)
+	if r.mapperFunc != nil {
+		req.SetMapperFunc(r.mapperFunc)
+	}
+	if r.deleted {
+		req.IncludeDeleted()
+	}
+	return req
+}
+
+// Collection returns the collection of T. Use it to create queries.
+// Note that entities in sub-collections must be queried using Request.ToCollection with the parent set
+func (r *Repository[T]) Collection() *firestore.CollectionRef {
+	return r.NewRequest().ToCollection(new(T))
+}
+
+// Get reads the entity by its id. The entity is returned when found - otherwise a NotFoundError.
+func (r *Repository[T]) Get(ctx context.Context, entity *T) func() (*T, error) {
+	future := r.NewRequest().GetEntities(ctx, entity)
+	return func() (*T, error) {
+		res, err := future()
+		if len(res) == 0 {
+			return nil, err
+		}
+		return entity, err
+	}
+}
+
+// GetByID reads the entity with the given id from the root collection of T
+func (r *Repository[T]) GetByID(ctx context.Context, id string) func() (*T, error) {
+	entity := new(T)
+	req := r.NewRequest()
+	req.SetID(entity, id)
+	return r.Get(ctx, entity)
+}
+
+// GetMulti reads the entities by their ids. Returns the found entities and a NotFoundError if some entities are not found.
+func (r *Repository[T]) GetMulti(ctx context.Context, entities []*T) func() ([]*T, error) {
+	future := r.NewRequest().GetEntities(ctx, entities)
+	return func() ([]*T, error) {
+		res, err := future()
+		return toTyped[T](res), err
+	}
+}
+
+// Create creates the entities and auto creates the ids if left empty
+func (r *Repository[T]) Create(ctx context.Context, entities ...*T) FutureFunc {
+	if len(entities) == 1 {
+		return r.NewRequest().CreateEntities(ctx, entities[0])
+	}
+	return r.NewRequest().CreateEntities(ctx, entities)
+}
+
+// Update updates the entities
+func (r *Repository[T]) Update(ctx context.Context, entities ...*T) FutureFunc {
+	if len(entities) == 1 {
+		return r.NewRequest().UpdateEntities(ctx, entities[0])
+	}
+	return r.NewRequest().UpdateEntities(ctx, entities)
+}
+
+// UpdateFields updates only the given fields of the entities. See Request.UpdateFields
+func (r *Repository[T]) UpdateFields(ctx context.Context, entity *T, fields ...string) FutureFunc {
+	return r.NewRequest().UpdateFields(ctx, entity, fields...)
+}
+
+// Delete deletes the entities. Entities supporting soft delete are stamped with the delete time instead
+func (r *Repository[T]) Delete(ctx context.Context, entities ...*T) FutureFunc {
+	if len(entities) == 1 {
+		return r.NewRequest().DeleteEntities(ctx, entities[0])
+	}
+	return r.NewRequest().DeleteEntities(ctx, entities)
+}
+
+// DeleteTree deletes the entities and all documents in their sub-collections. See Request.DeleteTree
+func (r *Repository[T]) DeleteTree(ctx context.Context, entities ...*T) FutureFunc {
+	return r.NewRequest().DeleteTree(ctx, entities)
+}
+
+// HardDelete deletes the entities even if they support soft delete
+func (r *Repository[T]) HardDelete(ctx context.Context, entities ...*T) FutureFunc {
+	if len(entities) == 1 {
+		return r.NewRequest().HardDeleteEntities(ctx, entities[0])
+	}
+	return r.NewRequest().HardDeleteEntities(ctx, entities)
+}
+
+// Restore restores the soft deleted entities
+func (r *Repository[T]) Restore(ctx context.Context, entities ...*T) FutureFunc {
+	if len(entities) == 1 {
+		return r.NewRequest().RestoreEntities(ctx, entities[0])
+	}
+	return r.NewRequest().RestoreEntities(ctx, entities)
+}
+
+// Query queries for entities of type T
+func (r *Repository[T]) Query(ctx context.Context, query firestore.Query) func() ([]*T, error) {
+	result := make([]*T, 0)
+	future := r.NewRequest().QueryEntities(ctx, query, &result)
+	return func() ([]*T, error) {
+		err := future()
+		return result, err
+	}
+}
+
+// Listen listens for changes of the entity until the context is done. See Request.ListenEntity
+func (r *Repository[T]) Listen(ctx context.Context, entity *T, callback ListenFunc) FutureFunc {
+	return r.NewRequest().ListenEntity(ctx, entity, callback)
+}
+
+// ListenQuery listens for changes of the query result until the context is done. The entities of the changes
+// are of type *T and the results of type []*T. See Request.ListenQuery
+func (r *Repository[T]) ListenQuery(ctx context.Context, query firestore.Query, callback ListenFunc) FutureFunc {
+	result := make([]*T, 0)
+	return r.NewRequest().ListenQuery(ctx, query, &result, callback)
+}
+
+func toTyped[T any](entities []interface{}) []*T {
+	result := make([]*T, 0, len(entities))
+	for _, e := range entities {
+		if t, ok := e.(*T); ok {
+			result = append(result, t)
+		}
+	}
+	return result
+}
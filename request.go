@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"time"
 )
 
 // Request a request builder for querying firestore
@@ -13,6 +14,17 @@ type Request struct {
 	FSC        *FSClient
 	loadPaths  []string
 	mapperFunc mapperFunc
+	atomic     bool
+	merge      bool
+	// includeDeleted includes the soft deleted entities in gets and queries
+	includeDeleted bool
+	// hardDelete deletes soft deletable entities
+	hardDelete bool
+	progress   ProgressFunc
+	// cascadePaths are the paths of the referenced entities that are written along with the entities
+	cascadePaths []string
+	// queryTTL is how long the results of QueryEntities are cached. Zero disables the query cache
+	queryTTL time.Duration
 }
 
 type mapperFunc func(map[string]interface{})
@@ -33,6 +45,53 @@ func (req *Request) SetLoadPaths(paths ...string) *Request {
 	return req
 }
 
+// SetCascadePaths makes CreateEntities and UpdateEntities write the entities referenced on the paths along with the entities.
+// The paths are given the same way as in SetLoadPaths. Referenced entities without an id are created and get a new id
+// - otherwise they are updated. The referenced entities are written first with the deepest references first unless the request
+// is atomic or in a transaction where everything is written at once. An entity is not written if any of its referenced
+// entities failed and it is reported as failed too. The failed referenced entities are reported with the index -1.
+func (req *Request) SetCascadePaths(paths ...string) *Request {
+	req.cascadePaths = paths
+	return req
+}
+
+// SetAtomic makes the writes of a slice of entities all-or-nothing by committing them in a single batch.
+// Atomic writes are limited to MaxBatchSize entities. Otherwise the entities are committed in
+// batches of MaxBatchSize and the writes of a failed batch are retried one at a time.
+func (req *Request) SetAtomic(atomic bool) *Request {
+	req.atomic = atomic
+	return req
+}
+
+// SetMerge makes UpdateEntities merge the fields of the entities into the existing documents
+// instead of overwriting them. Nested maps are merged recursively and empty (nil) fields are left untouched.
+func (req *Request) SetMerge(merge bool) *Request {
+	req.merge = merge
+	return req
+}
+
+// IncludeDeleted makes GetEntities and QueryEntities include the soft deleted entities. See FSClient.DeletedAtKey
+func (req *Request) IncludeDeleted() *Request {
+	req.includeDeleted = true
+	return req
+}
+
+// SetQueryCache caches the results of QueryEntities for the duration. The cached results of a collection are
+// invalidated when an entity in the collection is written through firestorm. Queries in transactions are not cached.
+// Queries are matched by their filters, orders, limits and cursors as they are sent to firestore so times only match
+// if they are the same instant.
+func (req *Request) SetQueryCache(ttl time.Duration) *Request {
+	req.queryTTL = ttl
+	return req
+}
+
+// SetProgress sets a func that is called with the number of documents processed so far by long running
+// operations such as DeleteTree
+func (req *Request) SetProgress(progress ProgressFunc) *Request {
+	req.progress = progress
+	return req
+}
+
 // ToCollection creates a firestore CollectionRef to the entity
 func (req *Request) ToCollection(entity interface{}) *firestore.CollectionRef {
 	path := getTypeName(entity)
@@ -48,7 +107,7 @@ func (req *Request) ToCollection(entity interface{}) *firestore.CollectionRef {
 
 // GetParent gets the patent of the entity
 func (req *Request) GetParent(entity interface{}) interface{} {
-	v, err := getIDValue(req.FSC.ParentKey, entity)
+	v, err := getParentValue(req.FSC.ParentKey, entity)
 	if err != nil {
 		return nil
 	}
@@ -65,40 +124,59 @@ func (req *Request) GetID(entity interface{}) string {
 }
 
 func getIDValue(id string, entity interface{}) (reflect.Value, error) {
+	if v, ok := getKeyValue(id, tagID, entity); ok {
+		return v, nil
+	}
+	return reflect.Value{}, fmt.Errorf("entity has no id field defined: %v", entity)
+}
+
+func getParentValue(parent string, entity interface{}) (reflect.Value, error) {
+	if v, ok := getKeyValue(parent, tagParent, entity); ok {
+		return v, nil
+	}
+	return reflect.Value{}, fmt.Errorf("entity has no parent field defined: %v", entity)
+}
+
+// getKeyValue finds the field tagged with the marker or otherwise the field with the given name. A tag anywhere in the
+// struct including its embedded structs takes precedence over the names. The outer fields are found before the embedded ones
+func getKeyValue(name, marker string, entity interface{}) (reflect.Value, bool) {
 	v := reflect.ValueOf(entity)
 	if cv, ok := entity.(reflect.Value); ok {
 		v = cv
 	}
 	v = reflect.Indirect(v)
-	if v.Kind() == reflect.Struct {
-		for i := 0; i < v.NumField(); i++ {
-			f := v.Field(i)
-			sf := v.Type().Field(i)
-
-			switch f.Kind() {
-			case reflect.Struct:
-				if sf.Anonymous {
-					if sv, err := getIDValue(id, f); err == nil {
-						return sv, nil
-					}
-				}
-			}
+	if v.Kind() != reflect.Struct {
+		return v, false
+	}
+	if f, ok := findKeyField(v, func(sf reflect.StructField) bool {
+		tag, ok := parseTag(sf)
+		return ok && ((marker == tagID && tag.id) || (marker == tagParent && tag.parent))
+	}); ok {
+		return f, true
+	}
+	if name == "" {
+		return reflect.Value{}, false
+	}
+	return findKeyField(v, func(sf reflect.StructField) bool {
+		return sf.Name == name
+	})
+}
 
-			// first check if id is statically set
-			if sf.Name == id {
-				return f, nil
-			}
-			// otherwise use the tag
-			/* not supported yet
-			if tag, ok := sf.Tag.Lookup("firestorm"); ok {
-				if tag == "id" {
-					return f, nil
-				}
+// findKeyField finds the first field matching in the struct and then in its embedded structs
+func findKeyField(v reflect.Value, match func(sf reflect.StructField) bool) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		if match(v.Type().Field(i)) {
+			return v.Field(i), true
+		}
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); v.Type().Field(i).Anonymous && f.Kind() == reflect.Struct {
+			if sv, ok := findKeyField(f, match); ok {
+				return sv, true
 			}
-			*/
 		}
 	}
-	return v, fmt.Errorf("entity has no id field defined: %v", entity)
+	return reflect.Value{}, false
 }
 
 // SetID sets the id field to the given id
@@ -157,8 +235,23 @@ func (req *Request) UpdateEntities(ctx context.Context, entities interface{}) Fu
 	return createErrorFunc(fmt.Sprintf("Kind not supported: %s", v.Kind().String()))
 }
 
-// DeleteEntities deletes the entities. Supply either a struct or a slice
-// as value or reference.
+// UpdateFields updates only the given fields of the entities and leaves the other fields untouched. The fields are
+// the field names in firestore (see TagName) or dot separated paths to nested fields. A field that is empty (nil) on the
+// entity is deleted. A field that is not mapped from the entity fails the update. Supply either a struct or a slice as
+// value or reference.
+func (req *Request) UpdateFields(ctx context.Context, entities interface{}, fields ...string) FutureFunc {
+	v := reflect.Indirect(reflect.ValueOf(entities))
+	switch v.Kind() {
+	case reflect.Struct:
+		return req.FSC.updateFieldsEntity(ctx, req, entities, fields)
+	case reflect.Slice:
+		return req.FSC.updateFieldsEntities(ctx, req, v, fields)
+	}
+	return createErrorFunc(fmt.Sprintf("Kind not supported: %s", v.Kind().String()))
+}
+
+// DeleteEntities deletes the entities. Entities supporting soft delete are stamped with the delete time instead.
+// See FSClient.DeletedAtKey. Supply either a struct or a slice as value or reference.
 func (req *Request) DeleteEntities(ctx context.Context, entities interface{}) FutureFunc {
 	v := reflect.Indirect(reflect.ValueOf(entities))
 	switch v.Kind() {
@@ -170,11 +263,78 @@ func (req *Request) DeleteEntities(ctx context.Context, entities interface{}) Fu
 	return createErrorFunc(fmt.Sprintf("Kind not supported: %s", v.Kind().String()))
 }
 
+// HardDeleteEntities deletes the entities from firestore even if they support soft delete. Supply either a struct or a slice
+// as value or reference.
+func (req *Request) HardDeleteEntities(ctx context.Context, entities interface{}) FutureFunc {
+	hard := *req
+	hard.hardDelete = true
+	return hard.DeleteEntities(ctx, entities)
+}
+
+// DeleteTree deletes the entities and all documents in their sub-collections recursively. Supply either a struct
+// or a slice as value or reference. Each sub-collection is read as a stream and its documents are deleted in batches as
+// they are read with the children before their parents, so an entity is only deleted if all its sub-documents were
+// deleted. The progress is reported after each batch. Failed documents are returned in a MultiError.
+// The entities are deleted even if they support soft delete. Use SetProgress to follow the progress.
+func (req *Request) DeleteTree(ctx context.Context, entities interface{}) FutureFunc {
+	v := reflect.Indirect(reflect.ValueOf(entities))
+	switch v.Kind() {
+	case reflect.Struct:
+		v = reflect.ValueOf([]interface{}{entities})
+		fallthrough
+	case reflect.Slice:
+		return req.FSC.deleteTrees(ctx, req, v)
+	}
+	return createErrorFunc(fmt.Sprintf("Kind not supported: %s", v.Kind().String()))
+}
+
+// RestoreEntities restores soft deleted entities by clearing their DeletedAtKey field. Supply either a struct or a slice
+// as value or reference.
+func (req *Request) RestoreEntities(ctx context.Context, entities interface{}) FutureFunc {
+	v := reflect.Indirect(reflect.ValueOf(entities))
+	switch v.Kind() {
+	case reflect.Struct:
+		return req.FSC.restoreEntity(ctx, req, entities)
+	case reflect.Slice:
+		return req.FSC.restoreEntities(ctx, req, v)
+	}
+	return createErrorFunc(fmt.Sprintf("Kind not supported: %s", v.Kind().String()))
+}
+
 // QueryEntities query for entities. Supply a reference to a slice for the result
 func (req *Request) QueryEntities(ctx context.Context, query firestore.Query, toSlicePtr interface{}) FutureFunc {
 	return req.FSC.queryEntities(ctx, req, query, toSlicePtr)
 }
 
+// ListenEntity listens for changes of the entity until the context is done. Each time the document changes the
+// callback is called with the change holding a new entity loaded from the document. The supplied entity is not
+// modified. A removed entity is reported as a new entity with only the id set. Supply a reference to a struct. The returned func blocks until the listener is stopped and returns the error
+// that stopped it if any. Missing referenced entities on the load paths do not stop the listener. The callback is called
+// from another go routine.
+func (req *Request) ListenEntity(ctx context.Context, entity interface{}, callback ListenFunc) FutureFunc {
+	if _, ok := getTransaction(ctx); ok {
+		return createErrorFunc("listeners are not supported in transactions")
+	}
+	if v := reflect.ValueOf(entity); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return createErrorFunc(fmt.Sprintf("Kind not supported: %s", v.Kind().String()))
+	}
+	return req.FSC.listenEntity(ctx, req, entity, callback)
+}
+
+// ListenQuery listens for changes of the query result until the context is done. Each time the result changes the
+// callback is called with the changed entities and a new slice with the current result (see Change.Result). The
+// supplied slice only sets the type of the result and is not modified. Supply a reference to a slice. The returned func blocks until the listener is stopped and returns the error that stopped it if any.
+// Missing referenced entities on the load paths do not stop the listener. The callback is called from another go routine.
+func (req *Request) ListenQuery(ctx context.Context, query firestore.Query, toSlicePtr interface{}, callback ListenFunc) FutureFunc {
+	if _, ok := getTransaction(ctx); ok {
+		return createErrorFunc("listeners are not supported in transactions")
+	}
+	if v := reflect.ValueOf(toSlicePtr); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return createErrorFunc(fmt.Sprintf("Kind not supported: %s", v.Kind().String()))
+	}
+	return req.FSC.listenQuery(ctx, req, query, toSlicePtr, callback)
+}
+
 func createErrorFunc(s string) func() error {
 	return func() error {
 		return errors.New(s)
@@ -0,0 +1,50 @@
+package firestorm
+
+import (
+	"testing"
+)
+
+type keyBase struct {
+	ID     string
+	Parent *keyBase
+}
+
+type taggedKeys struct {
+	keyBase
+	Key    string   `firestorm:"id"`
+	Owner  *keyBase `firestorm:"parent"`
+	Parent string
+}
+
+type embeddedTaggedKeys struct {
+	ID string
+	taggedBase
+}
+
+type taggedBase struct {
+	Key string `firestorm:"id"`
+}
+
+func TestGetKeyValue(t *testing.T) {
+	// the tags of the outer struct take precedence over the names in the embedded struct
+	e := &taggedKeys{keyBase: keyBase{ID: "base"}, Key: "key", Owner: &keyBase{ID: "owner"}}
+	if v, err := getIDValue("ID", e); err != nil || v.String() != "key" {
+		t.Errorf("the tagged id should have been found: %v %v", v, err)
+	}
+	if v, err := getParentValue("Parent", e); err != nil || v.Interface() != e.Owner {
+		t.Errorf("the tagged parent should have been found: %v %v", v, err)
+	}
+
+	// the tags of the embedded struct take precedence over the names in the outer struct
+	if v, err := getIDValue("ID", &embeddedTaggedKeys{ID: "outer", taggedBase: taggedBase{Key: "key"}}); err != nil || v.String() != "key" {
+		t.Errorf("the tagged id of the embedded struct should have been found: %v %v", v, err)
+	}
+
+	// otherwise the names are used
+	if v, err := getIDValue("ID", &keyBase{ID: "base"}); err != nil || v.String() != "base" {
+		t.Errorf("the named id should have been found: %v %v", v, err)
+	}
+	if _, err := getIDValue("Key", &keyBase{}); err == nil {
+		t.Errorf("the id should not have been found")
+	}
+}
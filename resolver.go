@@ -127,7 +127,7 @@ func (r *resolver) ResolveDocs(ctx context.Context, docs []*firestore.DocumentSn
 	col := r.NewRefCollector()
 	for i, doc := range docs {
 		if doc.Exists() {
-			m := doc.Data()
+			m := withMetadata(doc.Data(), docMetadata(doc))
 			r.resolveEntity(m, doc.Ref, col, r.paths...)
 			result[i] = m
 		} else {
@@ -185,9 +185,7 @@ func (r *resolver) resolveEntity(m entityMap, ref *firestore.DocumentRef, col *r
 		}
 		r.resolved[ref.Path] = m
 		m[r.fsc.IDKey] = ref.ID
-		//m["createtime"] = doc.CreateTime
-		//m["updatetime"] = doc.UpdateTime
-		//m["readtime"] = doc.ReadTime
+		r.fsc.toMetadataKeys(m)
 	}
 
 	for k, v := range m {
@@ -0,0 +1,103 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// deletedAtKey returns the firestore key of the DeletedAtKey field of the struct type.
+// False if soft delete is not used or the type has no such field.
+func (fsc *FSClient) deletedAtKey(t reflect.Type) (string, bool) {
+	if fsc.DeletedAtKey == "" {
+		return "", false
+	}
+	if t = baseType(t); t.Kind() != reflect.Struct {
+		return "", false
+	}
+	for _, sf := range structFields(t) {
+		if sf.Name != fsc.DeletedAtKey || (sf.Type != timeType && sf.Type != reflect.PtrTo(timeType)) {
+			continue
+		}
+		if tag, ok := parseTag(sf); ok && tag.name != "" {
+			return tag.name, true
+		}
+		return fsc.mappedKey(sf.Name), true
+	}
+	return "", false
+}
+
+// isDeleted checks if the entity map has been soft deleted
+func isDeleted(m map[string]interface{}, key string) bool {
+	t, ok := m[key].(time.Time)
+	return ok && !t.IsZero()
+}
+
+// setDeletedAt sets the DeletedAtKey field of the entity. A zero time clears it
+func (fsc *FSClient) setDeletedAt(entity interface{}, t time.Time) {
+	f, ok := getKeyValue(fsc.DeletedAtKey, "", entity)
+	if !ok || !f.CanSet() {
+		return
+	}
+	switch {
+	case t.IsZero():
+		f.Set(reflect.Zero(f.Type()))
+	case f.Type() == timeType:
+		f.Set(reflect.ValueOf(t))
+	default:
+		f.Set(reflect.ValueOf(&t))
+	}
+}
+
+// toSoftDeleteWrite creates a write stamping the DeletedAtKey field of the entity with the current time
+func (fsc *FSClient) toSoftDeleteWrite(ctx context.Context, req *Request, entity interface{}, key string) (write, error) {
+	now := time.Now()
+	fsc.setDeletedAt(entity, now)
+	updates := []firestore.Update{{FieldPath: firestore.FieldPath{key}, Value: now}}
+	w := write{op: updateOp, ref: req.ToRef(entity), updates: updates, entity: entity}
+	if fsc.OptimisticLocking {
+		_, w.lastUpdate = fsc.getSnapshot(ctx, w.ref)
+	}
+	return w, nil
+}
+
+// toRestoreWrite creates a write clearing the DeletedAtKey field of a soft deleted entity. It is set to null as
+// queries only match the entities that are not deleted by the null value
+func (fsc *FSClient) toRestoreWrite(ctx context.Context, req *Request, entity interface{}) (write, error) {
+	key, ok := fsc.deletedAtKey(reflect.TypeOf(entity))
+	if !ok {
+		return write{}, fmt.Errorf("entity does not support soft delete: %T", entity)
+	}
+	fsc.setDeletedAt(entity, time.Time{})
+	updates := []firestore.Update{{FieldPath: firestore.FieldPath{key}, Value: nil}}
+	w := write{op: updateOp, ref: req.ToRef(entity), updates: updates, entity: entity}
+	if fsc.OptimisticLocking {
+		_, w.lastUpdate = fsc.getSnapshot(ctx, w.ref)
+	}
+	return w, nil
+}
+
+// withoutDeleted adds a filter to the query leaving out the soft deleted entities of the slice element type unless
+// they are included by the request. The filter runs in firestore so it is applied before limits and cursors. Documents
+// without the DeletedAtKey field are not matched so they need to be saved with firestorm first
+func (fsc *FSClient) withoutDeletedQuery(req *Request, q firestore.Query, toSlicePtr interface{}) firestore.Query {
+	if key, ok := fsc.deletedAtKey(reflect.TypeOf(toSlicePtr)); ok && !req.includeDeleted {
+		return q.WherePath(firestore.FieldPath{key}, "==", nil)
+	}
+	return q
+}
+
+// withoutDeleted filters the soft deleted entities from the query result
+func withoutDeleted(refs []*firestore.DocumentRef, entities []entityMap, key string) ([]*firestore.DocumentRef, []entityMap) {
+	resRefs := make([]*firestore.DocumentRef, 0, len(refs))
+	resEntities := make([]entityMap, 0, len(entities))
+	for i, m := range entities {
+		if !isDeleted(m, key) {
+			resRefs = append(resRefs, refs[i])
+			resEntities = append(resEntities, m)
+		}
+	}
+	return resRefs, resEntities
+}
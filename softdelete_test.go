@@ -0,0 +1,44 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"testing"
+	"time"
+)
+
+type softContract struct {
+	ID        string
+	Title     string
+	DeletedAt time.Time
+}
+
+func TestSoftDeleteField(t *testing.T) {
+	t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	client, err := firestore.NewClient(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fsc := New(client, "ID", "")
+	fsc.DeletedAtKey = "DeletedAt"
+
+	// entities that are not deleted are saved with null so queries can filter on it
+	m, err := fsc.toDB(&softContract{Title: "Lease"})
+	if v, ok := m["deletedat"]; err != nil || !ok || v != nil {
+		t.Errorf("the field should have been saved as null: %v %v", m, err)
+	}
+	now := time.Now()
+	if m, _ := fsc.toDB(&softContract{Title: "Lease", DeletedAt: now}); m["deletedat"] != now {
+		t.Errorf("the delete time should have been saved: %v", m)
+	}
+
+	var contracts []softContract
+	q := client.Collection("softContract").Where("title", "==", "Lease")
+	_, filtered, _ := queryKey(fsc.withoutDeletedQuery(fsc.NewRequest(), q, &contracts))
+	_, included, _ := queryKey(fsc.withoutDeletedQuery(fsc.NewRequest().IncludeDeleted(), q, &contracts))
+	_, plain, _ := queryKey(q)
+	if filtered == plain || included != plain {
+		t.Errorf("only the query without the deleted entities should be filtered")
+	}
+}
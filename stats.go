@@ -0,0 +1,154 @@
+package firestorm
+
+import (
+	"sync"
+	"time"
+)
+
+// CacheLevelStats are the statistics of a cache level
+type CacheLevelStats struct {
+	// Hits and Misses are the number of keys found and not found in the cache
+	Hits, Misses int64
+	// Errors is the number of failed cache operations
+	Errors int64
+	// Operations is the number of calls to the cache and Latency their total duration
+	Operations int64
+	Latency    time.Duration
+}
+
+// HitRatio returns the ratio of the keys that were found in the cache
+func (s CacheLevelStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// AverageLatency returns the average duration of the calls to the cache
+func (s CacheLevelStats) AverageLatency() time.Duration {
+	if s.Operations == 0 {
+		return 0
+	}
+	return s.Latency / time.Duration(s.Operations)
+}
+
+func (s *CacheLevelStats) add(o CacheLevelStats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Errors += o.Errors
+	s.Operations += o.Operations
+	s.Latency += o.Latency
+}
+
+// CollectionCacheStats are the hits and misses of the entities of a collection. The operations and the latency are
+// only tracked per cache level
+type CollectionCacheStats struct {
+	Session, Second CacheLevelStats
+}
+
+// CacheStats are the statistics of the caches since the client was created
+type CacheStats struct {
+	// Session and Second are the statistics of the session cache and the second level cache
+	Session, Second CacheLevelStats
+	// Queries are the hits and misses of the cached queries. See Request.SetQueryCache
+	Queries CacheLevelStats
+	// Collections are the statistics per collection id
+	Collections map[string]CollectionCacheStats
+	// ReadsAvoided is the number of documents that were not read from firestore because they were found in a cache
+	// or read by a concurrent request
+	ReadsAvoided int64
+}
+
+// CacheStats returns a snapshot of the cache statistics
+func (fsc *FSClient) CacheStats() CacheStats {
+	return fsc.Cache.stats.snapshot()
+}
+
+const (
+	sessionLevel = iota
+	secondLevel
+)
+
+type cacheStats struct {
+	sync.Mutex
+	levels       [2]CacheLevelStats
+	queries      CacheLevelStats
+	collections  map[string]*CollectionCacheStats
+	readsAvoided int64
+}
+
+func newCacheStats() *cacheStats {
+	return &cacheStats{collections: make(map[string]*CollectionCacheStats)}
+}
+
+func (s *cacheStats) snapshot() CacheStats {
+	s.Lock()
+	defer s.Unlock()
+	result := CacheStats{
+		Session:      s.levels[sessionLevel],
+		Second:       s.levels[secondLevel],
+		Queries:      s.queries,
+		Collections:  make(map[string]CollectionCacheStats, len(s.collections)),
+		ReadsAvoided: s.readsAvoided,
+	}
+	for id, c := range s.collections {
+		result.Collections[id] = *c
+	}
+	return result
+}
+
+// observe records a call to the cache level that started at the given time. Cache misses are not errors
+func (s *cacheStats) observe(level int, start time.Time, err error) {
+	latency := time.Since(start)
+	s.Lock()
+	defer s.Unlock()
+	s.levels[level].add(CacheLevelStats{Operations: 1, Latency: latency})
+	if err != nil && err != ErrCacheMiss {
+		s.levels[level].Errors++
+	}
+}
+
+// lookup records the hits and misses of the keys looked up in the cache level. Found is only called if the lookup
+// did not fail
+func (s *cacheStats) lookup(level int, start time.Time, keys []string, found func(key string) bool, err error) {
+	s.observe(level, start, err)
+	if err != nil && err != ErrCacheMiss {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, key := range keys {
+		c, ok := s.collections[collectionID(key)]
+		if !ok {
+			c = &CollectionCacheStats{}
+			s.collections[collectionID(key)] = c
+		}
+		l := &c.Session
+		if level == secondLevel {
+			l = &c.Second
+		}
+		if err == nil && found(key) {
+			s.levels[level].Hits++
+			l.Hits++
+		} else {
+			s.levels[level].Misses++
+			l.Misses++
+		}
+	}
+}
+
+func (s *cacheStats) query(hit bool) {
+	s.Lock()
+	defer s.Unlock()
+	if hit {
+		s.queries.Hits++
+	} else {
+		s.queries.Misses++
+	}
+}
+
+func (s *cacheStats) avoided(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.readsAvoided += int64(n)
+}
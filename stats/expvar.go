@@ -0,0 +1,15 @@
+// Package stats exports the cache statistics of a firestorm client
+package stats
+
+import (
+	"expvar"
+	"github.com/jschoedt/go-firestorm"
+)
+
+// Publish publishes the cache statistics of the client as an expvar with the given name so they are served as JSON
+// on /debug/vars. Like expvar.Publish it panics if the name is already in use
+func Publish(name string, fsc *firestorm.FSClient) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return fsc.CacheStats()
+	}))
+}
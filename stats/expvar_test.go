@@ -0,0 +1,26 @@
+package stats_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"github.com/jschoedt/go-firestorm"
+	"github.com/jschoedt/go-firestorm/stats"
+	"testing"
+)
+
+func TestPublish(t *testing.T) {
+	fsc := firestorm.New(nil, "ID", "")
+	stats.Publish("firestorm", fsc)
+
+	v := expvar.Get("firestorm")
+	if v == nil {
+		t.Fatal("the statistics should have been published")
+	}
+	var result firestorm.CacheStats
+	if err := json.Unmarshal([]byte(v.String()), &result); err != nil {
+		t.Fatalf("the statistics should be JSON: %v", err)
+	}
+	if result.Session.Operations != 0 || len(result.Collections) != 0 {
+		t.Errorf("the statistics should be empty: %+v", result)
+	}
+}
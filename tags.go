@@ -0,0 +1,318 @@
+package firestorm
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// TagName is the name of the struct tag used to configure how a field is mapped. Eg.:
+//
+//	type Car struct {
+//		Key    string  `firestorm:"id"`            // the id of the document
+//		Garage *Garage `firestorm:"parent"`        // the parent in a sub-collection
+//		Make   string  `firestorm:"brand"`         // stored as 'brand'
+//		Owner  *Person `firestorm:"owner,omitempty"` // not stored when empty
+//		Temp   string  `firestorm:"-"`             // never stored or loaded
+//	}
+//
+// The names 'id' and 'parent' are reserved and mark the id and parent fields of the entity.
+const TagName = "firestorm"
+
+const (
+	tagID        = "id"
+	tagParent    = "parent"
+	tagIgnore    = "-"
+	tagOmitEmpty = "omitempty"
+)
+
+// taggedTypes caches if a type (or any of its nested types) has firestorm tags
+var taggedTypes sync.Map
+
+type fieldTag struct {
+	name      string
+	id        bool
+	parent    bool
+	ignore    bool
+	omitEmpty bool
+}
+
+func parseTag(sf reflect.StructField) (fieldTag, bool) {
+	tag, ok := sf.Tag.Lookup(TagName)
+	if !ok {
+		return fieldTag{}, false
+	}
+	parts := strings.Split(tag, ",")
+	t := fieldTag{}
+	switch parts[0] {
+	case tagIgnore:
+		t.ignore = true
+	case tagID:
+		t.id = true
+	case tagParent:
+		t.parent = true
+	default:
+		t.name = parts[0]
+	}
+	for _, opt := range parts[1:] {
+		if opt == tagOmitEmpty {
+			t.omitEmpty = true
+		}
+	}
+	return t, true
+}
+
+// hasTags checks if the struct type or any of its nested types uses firestorm tags
+func hasTags(t reflect.Type) bool {
+	t = baseType(t)
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	if v, ok := taggedTypes.Load(t); ok {
+		return v.(bool)
+	}
+	result := hasTagsVisit(t, make(map[reflect.Type]bool))
+	taggedTypes.Store(t, result)
+	return result
+}
+
+func hasTagsVisit(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	t = baseType(t)
+	if t.Kind() != reflect.Struct || visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if _, ok := sf.Tag.Lookup(TagName); ok || hasTagsVisit(sf.Type, visiting) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseType strips pointers, slices, arrays and maps from the type
+func baseType(t reflect.Type) reflect.Type {
+	for {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+			t = t.Elem()
+		default:
+			return t
+		}
+	}
+}
+
+// structFields returns the fields of the struct including the fields of embedded structs
+func structFields(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, structFields(sf.Type)...)
+			continue
+		}
+		fields = append(fields, sf)
+	}
+	return fields
+}
+
+// mappedKey returns the key the MapToDB mapper uses for the field name
+func (fsc *FSClient) mappedKey(name string) string {
+	_, key, _ := fsc.MapToDB.MapFunc(name, nil)
+	return key
+}
+
+// hasField checks if the path of firestore field names is mapped to a field of the type. The values of maps and
+// interfaces are not known so any path into them is accepted
+func (fsc *FSClient) hasField(t reflect.Type, path []string) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Interface:
+		return true
+	case reflect.Struct:
+	default:
+		return false
+	}
+	for _, sf := range structFields(t) {
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		key := fsc.mappedKey(sf.Name)
+		if tag, ok := parseTag(sf); ok {
+			if tag.ignore || tag.id {
+				continue
+			}
+			if tag.name != "" {
+				key = tag.name
+			}
+		}
+		if key == path[0] {
+			return len(path) == 1 || fsc.hasField(sf.Type, path[1:])
+		}
+	}
+	return false
+}
+
+// toDB maps the entity to a firestore map honoring the firestorm struct tags
+func (fsc *FSClient) toDB(entity interface{}) (map[string]interface{}, error) {
+	m, err := fsc.MapToDB.StructToMap(entity)
+	if err != nil {
+		return nil, err
+	}
+	v := reflect.Indirect(reflect.ValueOf(entity))
+	if v.Kind() == reflect.Struct && hasTags(v.Type()) {
+		fsc.applyToDBTags(v, m, make(map[uintptr]bool))
+	}
+	fsc.removeMetadataFields(m)
+	if key, ok := fsc.deletedAtKey(reflect.TypeOf(entity)); ok && !isDeleted(m, key) {
+		m[key] = nil // stored as null so queries can filter the deleted entities in firestore
+	}
+	return m, nil
+}
+
+func (fsc *FSClient) applyToDBTags(v reflect.Value, m map[string]interface{}, done map[uintptr]bool) {
+	p := reflect.ValueOf(m).Pointer()
+	if done[p] {
+		return
+	}
+	done[p] = true
+
+	renamed := make(map[string]interface{})
+	fsc.applyFieldTags(v, m, renamed, done)
+	for k, val := range renamed {
+		m[k] = val
+	}
+}
+
+// applyFieldTags applies the tags of the fields of the struct to the map. The renamed fields are added to renamed
+func (fsc *FSClient) applyFieldTags(v reflect.Value, m, renamed map[string]interface{}, done map[uintptr]bool) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		sf := v.Type().Field(i)
+
+		if sf.Anonymous && f.Kind() == reflect.Struct {
+			fsc.applyFieldTags(f, m, renamed, done) // embedded fields are merged into the same map
+			continue
+		}
+
+		key := fsc.mappedKey(sf.Name)
+		val, ok := m[key]
+		if !ok {
+			continue
+		}
+		if hasTags(sf.Type) {
+			fsc.applyNestedToDBTags(f, val, done)
+		}
+
+		tag, ok := parseTag(sf)
+		if !ok {
+			continue
+		}
+		switch {
+		case tag.ignore, tag.id, tag.omitEmpty && f.IsZero():
+			delete(m, key)
+		case tag.name != "" && tag.name != key:
+			delete(m, key)
+			renamed[tag.name] = val
+		}
+	}
+}
+
+func (fsc *FSClient) applyNestedToDBTags(f reflect.Value, val interface{}, done map[uintptr]bool) {
+	switch mv := val.(type) {
+	case map[string]interface{}:
+		if f = reflect.Indirect(f); f.Kind() == reflect.Struct {
+			fsc.applyToDBTags(f, mv, done)
+		}
+	case []map[string]interface{}:
+		for i := 0; i < len(mv) && i < f.Len(); i++ {
+			if elm := reflect.Indirect(f.Index(i)); elm.Kind() == reflect.Struct {
+				fsc.applyToDBTags(elm, mv[i], done)
+			}
+		}
+	}
+}
+
+// fromDB maps the firestore map to the entity honoring the firestorm struct tags
+func (fsc *FSClient) fromDB(m map[string]interface{}, entity interface{}) error {
+	if t := getStructType(entity); t.Kind() == reflect.Struct && hasTags(t) {
+		m = fsc.applyFromDBTags(t, m, make(map[uintptr]map[string]interface{}))
+	}
+	return fsc.MapFromDB.MapToStruct(m, entity)
+}
+
+// applyFromDBTags returns a copy of the map with the keys renamed to the field names of the struct
+func (fsc *FSClient) applyFromDBTags(t reflect.Type, m map[string]interface{}, done map[uintptr]map[string]interface{}) map[string]interface{} {
+	p := reflect.ValueOf(m).Pointer()
+	if c, ok := done[p]; ok {
+		return c
+	}
+	result := make(map[string]interface{}, len(m))
+	done[p] = result
+
+	renames := make(map[string]reflect.StructField)
+	dropped := make(map[string]bool)
+	types := make(map[string]reflect.Type)
+	for _, sf := range structFields(t) {
+		types[strings.ToLower(sf.Name)] = sf.Type
+		tag, ok := parseTag(sf)
+		if !ok {
+			continue
+		}
+		switch {
+		case tag.ignore:
+			dropped[strings.ToLower(sf.Name)] = true
+		case tag.id:
+			if id, ok := m[fsc.IDKey]; ok {
+				result[sf.Name] = id
+				dropped[strings.ToLower(fsc.IDKey)] = true
+			}
+		case tag.name != "":
+			renames[tag.name] = sf
+			dropped[strings.ToLower(sf.Name)] = true
+		}
+	}
+
+	for k, v := range m {
+		if sf, ok := renames[k]; ok {
+			result[sf.Name] = fsc.applyNestedFromDBTags(sf.Type, v, done)
+		} else if !dropped[strings.ToLower(k)] {
+			if typ, ok := types[strings.ToLower(k)]; ok {
+				v = fsc.applyNestedFromDBTags(typ, v, done)
+			}
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func (fsc *FSClient) applyNestedFromDBTags(t reflect.Type, v interface{}, done map[uintptr]map[string]interface{}) interface{} {
+	bt := baseType(t)
+	if bt.Kind() != reflect.Struct || !hasTags(bt) {
+		return v
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return fsc.applyFromDBTags(bt, val, done)
+	case []map[string]interface{}:
+		result := make([]map[string]interface{}, len(val))
+		for i, elm := range val {
+			result[i] = fsc.applyFromDBTags(bt, elm, done)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(val))
+		for i, elm := range val {
+			if em, ok := elm.(map[string]interface{}); ok {
+				result[i] = fsc.applyFromDBTags(bt, em, done)
+			} else {
+				result[i] = elm
+			}
+		}
+		return result
+	}
+	return v
+}
@@ -6,11 +6,14 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/jschoedt/go-firestorm"
 	"github.com/jschoedt/go-firestorm/cache"
+	"github.com/jschoedt/go-firestorm/codec"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestCacheCRUD(t *testing.T) {
+	restoreClient(t)
 	ctx := createSessionCacheContext()
 	memoryCache := cache.NewMemoryCache(5*time.Minute, 10*time.Minute)
 	fsc.SetCache(memoryCache)
@@ -39,6 +42,7 @@ func TestCacheCRUD(t *testing.T) {
 }
 
 func TestCacheTransaction(t *testing.T) {
+	restoreClient(t)
 	ctx := createSessionCacheContext()
 	memoryCache := cache.NewMemoryCache(5*time.Minute, 10*time.Minute)
 	fsc.SetCache(memoryCache)
@@ -135,3 +139,444 @@ func assertNotInCache(ctx context.Context, memoryCache *cache.InMemoryCache, car
 		t.Errorf("entity should not be in cache : %v", cacheKey)
 	}
 }
+
+func TestCacheUpdateFields(t *testing.T) {
+	restoreClient(t)
+	ctx := createSessionCacheContext()
+	memoryCache := cache.NewMemoryCache(5*time.Minute, 10*time.Minute)
+	fsc.SetCache(memoryCache)
+
+	car := &Car{Make: "Toyota", Tags: []string{"tag1"}}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+
+	// only the make is updated - other fields are left untouched
+	other := &Car{ID: car.ID, Make: "Jeep"}
+	if err := fsc.NewRequest().UpdateFields(ctx, other, "make")(); err != nil {
+		t.Errorf("fields should have been updated: %v", err)
+	}
+	m := getSessionCache(ctx)[fsc.NewRequest().ToRef(car).Path]
+	if m["make"] != "Jeep" || m["tags"] == nil {
+		t.Errorf("the entity in the session should have been patched: %v", m)
+	}
+	// another client may patch the entity concurrently so it is evicted from the second level
+	if _, err := memoryCache.Get(ctx, fsc.NewRequest().ToRef(car).Path); err != firestorm.ErrCacheMiss {
+		t.Errorf("the patched entity should have been evicted from the second level cache: %v", err)
+	}
+
+	loaded := &Car{ID: car.ID}
+	fsc.NewRequest().GetEntities(createSessionCacheContext(), loaded)()
+	if loaded.Make != "Jeep" || len(loaded.Tags) != 1 {
+		t.Errorf("only the make should have been updated: %v", loaded)
+	}
+
+	// merge leaves the empty fields untouched
+	other = &Car{ID: car.ID, Make: "Ford"}
+	fsc.NewRequest().SetMerge(true).UpdateEntities(ctx, other)()
+	loaded = &Car{ID: car.ID}
+	fsc.NewRequest().GetEntities(ctx, loaded)()
+	if loaded.Make != "Ford" || len(loaded.Tags) != 1 {
+		t.Errorf("the car should have been merged: %v", loaded)
+	}
+
+	// updating a field of a car not in the cache evicts it
+	uncached := &Car{ID: car.ID, Make: "Fiat"}
+	memoryCache.Delete(ctx, fsc.NewRequest().ToRef(car).Path)
+	delete(getSessionCache(ctx), fsc.NewRequest().ToRef(car).Path)
+	fsc.NewRequest().UpdateFields(ctx, uncached, "make")()
+	assertNotInCache(ctx, memoryCache, car, t)
+}
+
+func TestCacheDirtyTracking(t *testing.T) {
+	restoreClient(t)
+	ctx := createSessionCacheContext()
+	fsc.DirtyTracking = true
+
+	car := &Car{Make: "Toyota", Tags: []string{"tag1"}}
+	car.Year, _ = time.Parse(time.RFC3339, "2001-01-01T00:00:00.000Z")
+	fsc.NewRequest().CreateEntities(createSessionCacheContext(), car)()
+	defer cleanup(car)
+
+	loaded := &Car{ID: car.ID}
+	fsc.NewRequest().GetEntities(ctx, loaded)()
+
+	// someone else updates the tags after we loaded the car
+	other := &Car{ID: car.ID, Tags: []string{"tag2"}}
+	fsc.NewRequest().UpdateFields(createSessionCacheContext(), other, "tags")()
+
+	// only the changed make is written so the tags are not overwritten
+	loaded.Make = "Jeep"
+	if err := fsc.NewRequest().UpdateEntities(ctx, loaded)(); err != nil {
+		t.Errorf("the car should have been updated: %v", err)
+	}
+	fresh := &Car{ID: car.ID}
+	fsc.NewRequest().GetEntities(createSessionCacheContext(), fresh)()
+	if fresh.Make != "Jeep" || !fresh.Year.Equal(car.Year) || len(fresh.Tags) != 1 || fresh.Tags[0] != "tag2" {
+		t.Errorf("only the make should have been updated: %v", fresh)
+	}
+
+	// nothing changed so the deleted car is not written
+	fsc.NewRequest().DeleteEntities(createSessionCacheContext(), car)()
+	if err := fsc.NewRequest().UpdateEntities(ctx, loaded)(); err != nil {
+		t.Errorf("the unchanged car should not have been written: %v", err)
+	}
+}
+
+type byteCache struct {
+	sync.Mutex
+	items map[string][]byte
+}
+
+func (c *byteCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if data, ok := c.items[key]; ok {
+		return data, nil
+	}
+	return nil, firestorm.ErrCacheMiss
+}
+
+func (c *byteCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if data, err := c.Get(ctx, key); err == nil {
+			result[key] = data
+		}
+	}
+	return result, nil
+}
+
+func (c *byteCache) Set(ctx context.Context, key string, item []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	c.items[key] = item
+	return nil
+}
+
+func (c *byteCache) SetMulti(ctx context.Context, items map[string][]byte) error {
+	for key, item := range items {
+		c.Set(ctx, key, item)
+	}
+	return nil
+}
+
+func (c *byteCache) Delete(ctx context.Context, key string) error {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.items, key)
+	return nil
+}
+
+func (c *byteCache) DeleteMulti(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		c.Delete(ctx, key)
+	}
+	return nil
+}
+
+func TestCacheCodec(t *testing.T) {
+	restoreClient(t)
+	for name, cdc := range map[string]codec.Codec{"json": codec.JSON, "gob": codec.Gob, "msgpack": codec.Msgpack} {
+		fsc.SetByteCache(&byteCache{items: make(map[string][]byte)}, cdc)
+
+		owner := &Person{Name: "John"}
+		// the driver is a nested entity with a ref
+		car := &Car{Make: "Toyota", Owner: owner, Driver: Person{Name: "Jane", Spouse: owner}, Passengers: []Person{*owner}, Numbers: []int{1, 2}, Year: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)}
+		ctx := createSessionCacheContext()
+		fsc.NewRequest().CreateEntities(ctx, owner)()
+		car.Passengers[0].ID = owner.ID
+		fsc.NewRequest().CreateEntities(ctx, car)()
+
+		// a new session reads the car from the second level cache
+		otherCar := &Car{ID: car.ID}
+		if _, err := fsc.NewRequest().SetLoadPaths(firestorm.AllEntities).GetEntities(createSessionCacheContext(), otherCar)(); err != nil {
+			t.Errorf("%s: the car should have been read: %v", name, err)
+		}
+		if diff := cmp.Diff(car, otherCar); diff != "" {
+			t.Errorf("%s: the cached car should be unchanged: %s", name, diff)
+		}
+		cleanup(car, owner)
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	restoreClient(t)
+	ctx := createSessionCacheContext()
+	memoryCache := cache.NewMemoryCache(5*time.Minute, 10*time.Minute)
+	fsc.SetCache(memoryCache)
+
+	// persons are never cached in the second level
+	fsc.SetTypeCachePolicy(Person{}, firestorm.CachePolicy{NoCache: true})
+	t.Cleanup(func() { fsc.SetTypeCachePolicy(Person{}, firestorm.CachePolicy{}) })
+	person := &Person{Name: "John"}
+	fsc.NewRequest().CreateEntities(ctx, person)()
+	defer cleanup(person)
+	if _, err := memoryCache.Get(ctx, fsc.NewRequest().ToRef(person).Path); err != firestorm.ErrCacheMiss {
+		t.Errorf("the person should not be cached: %v", err)
+	}
+
+	// cars are removed from the second level cache on writes and cached again on reads
+	fsc.SetTypeCachePolicy(Car{}, firestorm.CachePolicy{Invalidate: true, TTL: time.Minute})
+	t.Cleanup(func() { fsc.SetTypeCachePolicy(Car{}, firestorm.CachePolicy{}) })
+	car := &Car{Make: "Toyota"}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+	assertNotInCache(createSessionCacheContext(), memoryCache, car, t)
+
+	fsc.NewRequest().GetEntities(createSessionCacheContext(), &Car{ID: car.ID})()
+	if _, err := memoryCache.Get(ctx, fsc.NewRequest().ToRef(car).Path); err != nil {
+		t.Errorf("the car should have been cached on read: %v", err)
+	}
+
+	// reads in a transaction are not written
+	fsc.DoInTransaction(ctx, func(tctx context.Context) error {
+		_, err := fsc.NewRequest().GetEntities(tctx, &Car{ID: car.ID})()
+		return err
+	})
+	if _, err := memoryCache.Get(ctx, fsc.NewRequest().ToRef(car).Path); err != nil {
+		t.Errorf("the car read in a transaction should still be cached: %v", err)
+	}
+
+	fsc.DoInTransaction(ctx, func(tctx context.Context) error {
+		car.Make = "Jeep"
+		return fsc.NewRequest().UpdateEntities(tctx, car)()
+	})
+	assertNotInCache(createSessionCacheContext(), memoryCache, car, t)
+}
+
+func TestCacheNotFound(t *testing.T) {
+	restoreClient(t)
+	memoryCache := cache.NewMemoryCache(5*time.Minute, 10*time.Minute)
+	fsc.SetCache(memoryCache)
+	fsc.SetTypeCachePolicy(Car{}, firestorm.CachePolicy{NotFoundTTL: time.Minute})
+	t.Cleanup(func() { fsc.SetTypeCachePolicy(Car{}, firestorm.CachePolicy{}) })
+
+	car := &Car{ID: "MissingCar", Make: "Toyota"}
+	cacheKey := fsc.NewRequest().ToRef(car).Path
+	if _, err := fsc.NewRequest().GetEntities(createSessionCacheContext(), car)(); !errors.As(err, &firestorm.NotFoundError{}) {
+		t.Errorf("the car should not be found: %v", err)
+	}
+	if m, err := memoryCache.Get(context.Background(), cacheKey); err != nil || len(m) == 0 {
+		t.Errorf("the missing car should have been cached: %v %v", m, err)
+	}
+
+	// the owner is a dangling reference that is not found again
+	owner := &Person{ID: "MissingOwner"}
+	fsc.SetTypeCachePolicy(Person{}, firestorm.CachePolicy{NotFoundTTL: time.Minute})
+	t.Cleanup(func() { fsc.SetTypeCachePolicy(Person{}, firestorm.CachePolicy{}) })
+	fsc.NewRequest().GetEntities(createSessionCacheContext(), owner)()
+	ownedCar := &Car{Make: "Volvo", Owner: owner}
+	fsc.NewRequest().CreateEntities(createSessionCacheContext(), ownedCar)()
+	defer cleanup(ownedCar)
+	if _, err := fsc.NewRequest().SetLoadPaths("owner").GetEntities(createSessionCacheContext(), &Car{ID: ownedCar.ID})(); !errors.As(err, &firestorm.NotFoundError{}) {
+		t.Errorf("the owner should not be found: %v", err)
+	}
+
+	// creating the car clears the not found entry
+	fsc.NewRequest().CreateEntities(createSessionCacheContext(), car)()
+	defer cleanup(car)
+	if _, err := fsc.NewRequest().GetEntities(createSessionCacheContext(), &Car{ID: car.ID})(); err != nil {
+		t.Errorf("the created car should be found: %v", err)
+	}
+}
+
+func TestCacheConcurrentLoads(t *testing.T) {
+	owner := &Person{Name: "John"}
+	car := &Car{Make: "Toyota", Owner: owner}
+	fsc.NewRequest().CreateEntities(context.Background(), owner)()
+	fsc.NewRequest().CreateEntities(context.Background(), car)()
+	defer cleanup(car, owner)
+
+	// the concurrent requests share the reads of the car and the owner
+	var wg sync.WaitGroup
+	cars := make([]*Car, 20)
+	for i := range cars {
+		cars[i] = &Car{ID: car.ID}
+		wg.Add(1)
+		go func(c *Car) {
+			defer wg.Done()
+			if _, err := fsc.NewRequest().SetLoadPaths("owner").GetEntities(createSessionCacheContext(), c)(); err != nil {
+				t.Errorf("the car should have been read: %v", err)
+			}
+		}(cars[i])
+	}
+	wg.Wait()
+	for _, c := range cars {
+		if c.Make != "Toyota" || c.Owner == nil || c.Owner.Name != "John" {
+			t.Errorf("the car should have been read with the owner: %+v", c)
+		}
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	ctx := createSessionCacheContext()
+	car := &Car{Make: "QueryCache"}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+
+	query := fsc.NewRequest().ToCollection(car).Where("make", "==", "QueryCache")
+	queryCars := func() []Car {
+		result := make([]Car, 0)
+		if err := fsc.NewRequest().SetQueryCache(time.Minute).QueryEntities(createSessionCacheContext(), query, &result)(); err != nil {
+			t.Errorf("the query should not fail: %v", err)
+		}
+		return result
+	}
+	if result := queryCars(); len(result) != 1 {
+		t.Errorf("the car should have been found: %v", result)
+	}
+
+	// writes bypassing firestorm are not seen until the cached query expires
+	ref := fsc.NewRequest().ToCollection(car).NewDoc()
+	ref.Set(context.Background(), map[string]interface{}{"make": "QueryCache"})
+	defer ref.Delete(context.Background())
+	if result := queryCars(); len(result) != 1 {
+		t.Errorf("the query should have been cached: %v", result)
+	}
+
+	// writes through firestorm invalidate the cached queries of the collection
+	otherCar := &Car{Make: "QueryCache"}
+	fsc.NewRequest().CreateEntities(ctx, otherCar)()
+	defer cleanup(otherCar)
+	if result := queryCars(); len(result) != 3 {
+		t.Errorf("the cached query should have been invalidated: %v", result)
+	}
+}
+
+func TestCacheInvalidationBus(t *testing.T) {
+	restoreClient(t)
+	ctx, cancel := context.WithCancel(createSessionCacheContext())
+	defer cancel()
+	bus := cache.NewLocalBus()
+
+	// two clients with their own local cache sharing the bus
+	memoryCache := cache.NewMemoryCache(5*time.Minute, 10*time.Minute)
+	fsc.SetCache(memoryCache)
+	if err := fsc.SetInvalidationBus(ctx, bus); err != nil {
+		t.Fatalf("the bus should have been set: %v", err)
+	}
+	other := firestorm.New(fsc.Client, "ID", "")
+	otherCache := cache.NewMemoryCache(5*time.Minute, 10*time.Minute)
+	other.SetCache(otherCache)
+	if err := other.SetInvalidationBus(ctx, bus); err != nil {
+		t.Fatalf("the bus should have been set: %v", err)
+	}
+
+	car := &Car{Make: "Toyota"}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+	key := fsc.NewRequest().ToRef(car).Path
+	other.NewRequest().GetEntities(createSessionCacheContext(), car)()
+	if _, err := otherCache.Get(ctx, key); err != nil {
+		t.Errorf("the car should have been cached by the other client: %v", err)
+	}
+
+	// the update evicts the car from the other cache
+	car.Make = "Jeep"
+	fsc.NewRequest().UpdateEntities(createSessionCacheContext(), car)()
+	if _, err := memoryCache.Get(ctx, key); err != nil {
+		t.Errorf("the car should still be cached by the writing client: %v", err)
+	}
+	if _, err := otherCache.Get(ctx, key); err != firestorm.ErrCacheMiss {
+		t.Errorf("the car should have been evicted from the other cache: %v", err)
+	}
+
+	// so are writes in transactions
+	other.NewRequest().GetEntities(createSessionCacheContext(), car)()
+	fsc.DoInTransaction(createSessionCacheContext(), func(tctx context.Context) error {
+		car.Make = "Volvo"
+		return fsc.NewRequest().UpdateEntities(tctx, car)()
+	})
+	if _, err := otherCache.Get(ctx, key); err != firestorm.ErrCacheMiss {
+		t.Errorf("the car should have been evicted from the other cache: %v", err)
+	}
+	result := &Car{ID: car.ID}
+	other.NewRequest().GetEntities(createSessionCacheContext(), result)()
+	if result.Make != "Volvo" {
+		t.Errorf("the other client should have read the new car: %v", result)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	restoreClient(t)
+	ctx := createSessionCacheContext()
+	fsc.SetCache(cache.NewMemoryCache(5*time.Minute, 10*time.Minute))
+
+	car := &Car{Make: "Toyota"}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+
+	before := fsc.CacheStats()
+	// found in the session cache
+	fsc.NewRequest().GetEntities(ctx, &Car{ID: car.ID})()
+	// found in the second level cache
+	fsc.NewRequest().GetEntities(createSessionCacheContext(), &Car{ID: car.ID})()
+	after := fsc.CacheStats()
+
+	if hits := after.Session.Hits - before.Session.Hits; hits != 1 {
+		t.Errorf("there should have been 1 session hit: %v", hits)
+	}
+	if hits := after.Second.Hits - before.Second.Hits; hits != 1 {
+		t.Errorf("there should have been 1 second level hit: %v", hits)
+	}
+	if hits := after.Collections["Car"].Second.Hits - before.Collections["Car"].Second.Hits; hits != 1 {
+		t.Errorf("there should have been 1 second level hit in the collection: %v", hits)
+	}
+	if avoided := after.ReadsAvoided - before.ReadsAvoided; avoided != 2 {
+		t.Errorf("2 reads should have been avoided: %v", avoided)
+	}
+	if after.Second.Operations <= before.Second.Operations || after.Second.AverageLatency() <= 0 {
+		t.Errorf("the second level operations should have been timed: %+v", after.Second)
+	}
+}
+
+type logEntry struct {
+	level  firestorm.LogLevel
+	msg    string
+	fields []interface{}
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Log(ctx context.Context, level firestorm.LogLevel, msg string, fields ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, fields})
+}
+
+type failingCache struct {
+	*cache.InMemoryCache
+}
+
+func (c failingCache) SetMulti(ctx context.Context, items map[string]firestorm.EntityMap) error {
+	return errors.New("cache is down")
+}
+
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	client := firestorm.New(fsc.Client, "ID", "")
+	client.Logger = logger
+	client.SetCache(failingCache{cache.NewMemoryCache(5*time.Minute, 10*time.Minute)})
+
+	// no session cache in the context
+	car := &Car{Make: "Toyota"}
+	client.NewRequest().CreateEntities(context.Background(), car)()
+	defer cleanup(car)
+	client.NewRequest().GetEntities(context.Background(), car)()
+
+	if len(logger.entries) < 2 {
+		t.Fatalf("the warning and the cache errors should have been logged: %v", logger.entries)
+	}
+	if e := logger.entries[0]; e.level != firestorm.LevelWarn {
+		t.Errorf("the missing session cache should have been warned once: %v", logger.entries)
+	}
+	path := client.NewRequest().ToRef(car).Path
+	for _, e := range logger.entries[1:] {
+		if e.level != firestorm.LevelError || !cmp.Equal(e.fields[2:4], []interface{}{"paths", []string{path}}) {
+			t.Errorf("the cache error should have been logged with the path: %v", e)
+		}
+	}
+}
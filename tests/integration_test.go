@@ -3,8 +3,13 @@ package firestormtests
 import (
 	"cloud.google.com/go/firestore"
 	"context"
+	"errors"
 	"github.com/google/go-cmp/cmp"
 	"github.com/jschoedt/go-firestorm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -135,6 +140,61 @@ func testConcurrency_(ctx context.Context, t *testing.T) {
 	}
 }
 
+// LimitedCar records the peak number of concurrent saves
+type LimitedCar struct {
+	ID   string
+	Make string
+}
+
+var limitedInFlight, limitedPeak int
+var limitedMu sync.Mutex
+
+func (c *LimitedCar) BeforeSave(ctx context.Context) error {
+	limitedMu.Lock()
+	limitedInFlight++
+	if limitedInFlight > limitedPeak {
+		limitedPeak = limitedInFlight
+	}
+	limitedMu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	limitedMu.Lock()
+	limitedInFlight--
+	limitedMu.Unlock()
+	return nil
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	testRunner(t, testConcurrencyLimits_)
+}
+func testConcurrencyLimits_(ctx context.Context, t *testing.T) {
+	fsc.SetConcurrency(2, 2)
+	t.Cleanup(func() { fsc.SetConcurrency(0, 0) })
+	limitedPeak = 0
+
+	cars := make([]*LimitedCar, 10)
+	futures := make([]firestorm.FutureFunc, len(cars))
+	for i := range cars {
+		cars[i] = &LimitedCar{Make: "Toyota"}
+		futures[i] = fsc.NewRequest().CreateEntities(ctx, cars[i])
+	}
+	for _, future := range futures {
+		if err := future(); err != nil {
+			t.Errorf("car should have been created: %v", err)
+		}
+	}
+	defer cleanup(cars)
+	if limitedPeak > 2 {
+		t.Errorf("the writes in flight should have been limited to 2: %d", limitedPeak)
+	}
+
+	// queued operations are cancelled with the context
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := fsc.NewRequest().GetEntities(cancelCtx, cars)(); err == nil {
+		t.Errorf("We expect the cancelled context to fail the request")
+	}
+}
+
 func TestRelations(t *testing.T) {
 	testRunner(t, testRelations_)
 }
@@ -367,3 +427,610 @@ func testAnonymousStructs_(ctx context.Context, t *testing.T) {
 		t.Errorf("name should match: %s", otherSub.LocalName)
 	}
 }
+
+type Garage struct {
+	Key     string `firestorm:"id"`
+	Address string `firestorm:"street"`
+}
+
+type TaggedCar struct {
+	Key    string   `firestorm:"id"`
+	Garage *Garage  `firestorm:"parent"`
+	Make   string   `firestorm:"brand"`
+	Owner  *Person  `firestorm:"owner,omitempty"`
+	Tags   []string `firestorm:"labels,omitempty"`
+	Temp   string   `firestorm:"-"`
+}
+
+func TestStructTags(t *testing.T) {
+	testRunner(t, testStructTags_)
+}
+func testStructTags_(ctx context.Context, t *testing.T) {
+	garage := &Garage{Address: "Main Street"}
+	fsc.NewRequest().CreateEntities(ctx, garage)()
+	defer cleanup(garage)
+
+	car := &TaggedCar{Garage: garage, Make: "Toyota", Temp: "temp"}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+
+	if car.Key == "" {
+		t.Errorf("car should have an auto generated ID")
+	}
+
+	// Reverting to the Firestore API we can test the stored fields
+	snapshot, _ := fsc.Client.Collection("Garage").Doc(garage.Key).Collection("TaggedCar").Doc(car.Key).Get(ctx)
+	data := snapshot.Data()
+	if data["brand"] != "Toyota" {
+		t.Errorf("make should have been stored as brand: %v", data)
+	}
+	for _, key := range []string{"make", "key", "temp", "owner", "labels"} {
+		if _, ok := data[key]; ok {
+			t.Errorf("%s should not have been stored: %v", key, data)
+		}
+	}
+
+	otherCar := &TaggedCar{Key: car.Key, Garage: &Garage{Key: garage.Key}}
+	fsc.NewRequest().SetLoadPaths("garage").GetEntities(ctx, otherCar)()
+	if otherCar.Make != "Toyota" || otherCar.Temp != "" {
+		t.Errorf("car should have brand Toyota and no temp: %v", otherCar)
+	}
+	if otherCar.Garage == nil || otherCar.Garage.Address != garage.Address {
+		t.Errorf("the parent garage should have been loaded: %v", otherCar.Garage)
+	}
+}
+
+type TaggedBase struct {
+	Key  string `firestorm:"id"`
+	Make string `firestorm:"brand"`
+}
+
+type EmbeddedTaggedCar struct {
+	TaggedBase
+	Model string `firestorm:"type"`
+}
+
+func TestEmbeddedStructTags(t *testing.T) {
+	testRunner(t, testEmbeddedStructTags_)
+}
+func testEmbeddedStructTags_(ctx context.Context, t *testing.T) {
+	car := &EmbeddedTaggedCar{Model: "Prius"}
+	car.Make = "Toyota"
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+
+	if car.Key == "" {
+		t.Errorf("car should have an auto generated ID")
+	}
+
+	// Reverting to the Firestore API we can test the stored fields
+	snapshot, _ := fsc.Client.Collection("EmbeddedTaggedCar").Doc(car.Key).Get(ctx)
+	data := snapshot.Data()
+	if data["brand"] != "Toyota" || data["type"] != "Prius" {
+		t.Errorf("make and model should have been stored as brand and type: %v", data)
+	}
+	for _, key := range []string{"make", "key", "model"} {
+		if _, ok := data[key]; ok {
+			t.Errorf("%s should not have been stored: %v", key, data)
+		}
+	}
+
+	otherCar := &EmbeddedTaggedCar{}
+	otherCar.Key = car.Key
+	fsc.NewRequest().GetEntities(ctx, otherCar)()
+	if otherCar.Make != "Toyota" || otherCar.Model != "Prius" {
+		t.Errorf("car should have brand Toyota and type Prius: %v", otherCar)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	testRunner(t, testBatch_)
+}
+func testBatch_(ctx context.Context, t *testing.T) {
+	cars := make([]*Car, firestorm.MaxBatchSize+1)
+	for i := range cars {
+		cars[i] = &Car{Make: "Toyota"}
+	}
+
+	// Too many entities for a single atomic batch
+	if err := fsc.NewRequest().SetAtomic(true).CreateEntities(ctx, cars)(); err == nil {
+		t.Errorf("We expect atomic writes to be limited to a single batch")
+	}
+
+	// Committed in two batches
+	if err := fsc.NewRequest().CreateEntities(ctx, cars)(); err != nil {
+		t.Errorf("cars should have been created: %v", err)
+	}
+	for _, car := range cars {
+		if car.ID == "" {
+			t.Errorf("car should have an auto generated ID")
+		}
+	}
+
+	result, err := fsc.NewRequest().GetEntities(ctx, cars)()
+	if err != nil || len(result) != len(cars) {
+		t.Errorf("all cars should have been loaded: %v - %v", len(result), err)
+	}
+
+	if err := fsc.NewRequest().DeleteEntities(ctx, cars)(); err != nil {
+		t.Errorf("cars should have been deleted: %v", err)
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	testRunner(t, testMultiError_)
+}
+func testMultiError_(ctx context.Context, t *testing.T) {
+	car := &Car{ID: "MultiErrorCar", Make: "Toyota"}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+
+	// only the existing car fails
+	cars := []*Car{{Make: "Jeep"}, {ID: car.ID, Make: "Jeep"}}
+	err := fsc.NewRequest().CreateEntities(ctx, cars)()
+	defer cleanup(cars[0])
+
+	var multiErr firestorm.MultiError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("We expect a MultiError: %v", err)
+	}
+	if len(multiErr.Errors) != 1 || len(multiErr.Entities()) != 1 {
+		t.Fatalf("Only the existing car should have failed: %v", multiErr)
+	}
+	if multiErr.Errors[0].Index != 1 || multiErr.Errors[0].Ref.ID != car.ID {
+		t.Errorf("The error should point to the existing car: %v", multiErr.Errors[0])
+	}
+	var existsErr firestorm.AlreadyExistsError
+	if !errors.As(err, &existsErr) || existsErr.Ref.ID != car.ID || status.Code(errors.Unwrap(existsErr)) != codes.AlreadyExists {
+		t.Errorf("The underlying error should be kept: %v", multiErr.Errors[0].Err)
+	}
+
+	// the other car is written
+	otherCar := &Car{ID: cars[0].ID}
+	if _, err := fsc.NewRequest().GetEntities(ctx, otherCar)(); err != nil || otherCar.Make != "Jeep" {
+		t.Errorf("The new car should have been written: %v %v", otherCar, err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	testRunner(t, testTypedErrors_)
+}
+func testTypedErrors_(ctx context.Context, t *testing.T) {
+	car := &Car{Make: "Toyota"}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	defer cleanup(car)
+
+	otherCar := &Car{ID: car.ID, Make: "Jeep"}
+	err := fsc.NewRequest().CreateEntities(ctx, otherCar)()
+	var existsErr firestorm.AlreadyExistsError
+	if !errors.As(err, &existsErr) {
+		t.Fatalf("We expect an AlreadyExistsError: %v", err)
+	}
+	if existsErr.Ref.ID != car.ID || existsErr.Entity != otherCar {
+		t.Errorf("The error should point to the existing car: %v", existsErr)
+	}
+
+	// the create fails when the transaction is committed
+	err = fsc.DoInTransaction(ctx, func(tctx context.Context) error {
+		return fsc.NewRequest().CreateEntities(tctx, otherCar)()
+	})
+	if !errors.As(err, &existsErr) {
+		t.Errorf("We expect an AlreadyExistsError from the transaction: %v", err)
+	}
+}
+
+func TestOptimisticLocking(t *testing.T) {
+	ctx := createSessionCacheContext()
+	restoreClient(t)
+	fsc.OptimisticLocking = true
+
+	car := &Car{Make: "Toyota"}
+	fsc.NewRequest().CreateEntities(createSessionCacheContext(), car)()
+	defer cleanup(car)
+
+	loaded := &Car{ID: car.ID}
+	fsc.NewRequest().GetEntities(ctx, loaded)()
+
+	// someone else updates the car after we loaded it
+	other := &Car{ID: car.ID, Make: "Jeep"}
+	fsc.NewRequest().UpdateEntities(createSessionCacheContext(), other)()
+
+	var conflictErr firestorm.ConflictError
+	loaded.Make = "Ford"
+	if err := fsc.NewRequest().UpdateEntities(ctx, loaded)(); !errors.As(err, &conflictErr) {
+		t.Errorf("We expect a ConflictError: %v", err)
+	}
+	if err := fsc.NewRequest().DeleteEntities(ctx, loaded)(); !errors.As(err, &conflictErr) {
+		t.Errorf("We expect a ConflictError: %v", err)
+	}
+	err := fsc.DoInTransaction(ctx, func(tctx context.Context) error {
+		return fsc.NewRequest().UpdateEntities(tctx, loaded)()
+	})
+	if !errors.As(err, &conflictErr) {
+		t.Errorf("We expect a ConflictError from the transaction: %v", err)
+	}
+
+	// the car can be updated when it has been reloaded
+	delete(getSessionCache(ctx), fsc.NewRequest().ToRef(car).Path)
+	fsc.NewRequest().GetEntities(ctx, loaded)()
+	loaded.Make = "Ford"
+	if err := fsc.NewRequest().UpdateEntities(ctx, loaded)(); err != nil {
+		t.Errorf("The reloaded car should have been updated: %v", err)
+	}
+	// the update time of the write is tracked so it can be updated again
+	loaded.Make = "Fiat"
+	if err := fsc.NewRequest().UpdateEntities(ctx, loaded)(); err != nil {
+		t.Errorf("The car should have been updated again: %v", err)
+	}
+}
+
+type Invoice struct {
+	ID      string
+	Amount  int
+	Created time.Time
+	Updated time.Time
+	Read    time.Time
+}
+
+func TestMetadata(t *testing.T) {
+	restoreClient(t)
+	fsc.CreateTimeKey, fsc.UpdateTimeKey, fsc.ReadTimeKey = "Created", "Updated", "Read"
+	testRunner(t, testMetadata_)
+}
+func testMetadata_(ctx context.Context, t *testing.T) {
+	invoice := &Invoice{Amount: 100}
+	fsc.NewRequest().CreateEntities(ctx, invoice)()
+	defer cleanup(invoice)
+	if invoice.Created.IsZero() || !invoice.Created.Equal(invoice.Updated) {
+		t.Errorf("the write times should have been set: %v", invoice)
+	}
+
+	created := invoice.Created
+	invoice.Amount = 200
+	fsc.NewRequest().UpdateEntities(ctx, invoice)()
+	if !invoice.Updated.After(created) || !invoice.Created.Equal(created) {
+		t.Errorf("the update time should have been set: %v", invoice)
+	}
+
+	// the times are loaded from firestore or the cache
+	loaded := &Invoice{ID: invoice.ID}
+	fsc.NewRequest().GetEntities(ctx, loaded)()
+	if !loaded.Created.Equal(created) || !loaded.Updated.Equal(invoice.Updated) || loaded.Read.IsZero() {
+		t.Errorf("the times should have been loaded: %v", loaded)
+	}
+
+	var invoices []*Invoice
+	q := fsc.Client.Collection("Invoice").Where("amount", "==", 200)
+	fsc.NewRequest().QueryEntities(ctx, q, &invoices)()
+	if len(invoices) != 1 || !invoices[0].Updated.Equal(invoice.Updated) {
+		t.Errorf("the times should have been queried: %v", invoices)
+	}
+
+	// the times are not saved as fields
+	doc, _ := fsc.NewRequest().ToRef(invoice).Get(ctx)
+	if _, ok := doc.Data()["created"]; ok {
+		t.Errorf("the create time should not have been saved: %v", doc.Data())
+	}
+}
+
+var errProtected = errors.New("account is protected")
+
+type Account struct {
+	ID        string
+	Email     string
+	Protected bool
+	Loaded    bool `firestorm:"-"`
+}
+
+func (a *Account) BeforeSave(ctx context.Context) error {
+	if a.Email == "" {
+		return errors.New("email is required")
+	}
+	a.Email = strings.ToLower(a.Email)
+	return nil
+}
+
+func (a *Account) AfterLoad(ctx context.Context) error {
+	a.Loaded = true
+	return nil
+}
+
+func (a *Account) BeforeDelete(ctx context.Context) error {
+	if a.Protected {
+		return errProtected
+	}
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	testRunner(t, testHooks_)
+}
+func testHooks_(ctx context.Context, t *testing.T) {
+	account := &Account{Email: "John@Example.com", Protected: true}
+	if err := fsc.NewRequest().CreateEntities(ctx, account)(); err != nil {
+		t.Fatalf("the account should have been created: %v", err)
+	}
+	defer fsc.NewRequest().DeleteEntities(ctx, &Account{ID: account.ID})()
+	if account.Email != "john@example.com" {
+		t.Errorf("the email should have been normalized: %v", account.Email)
+	}
+
+	// the hook error aborts the write
+	if err := fsc.NewRequest().CreateEntities(ctx, &Account{})(); err == nil {
+		t.Errorf("the account without email should not have been created")
+	}
+	if err := fsc.NewRequest().DeleteEntities(ctx, account)(); !errors.Is(err, errProtected) {
+		t.Errorf("the protected account should not have been deleted: %v", err)
+	}
+
+	loaded := &Account{ID: account.ID}
+	fsc.NewRequest().GetEntities(ctx, loaded)()
+	if !loaded.Loaded || loaded.Email != account.Email {
+		t.Errorf("the after load hook should have been called: %v", loaded)
+	}
+
+	var accounts []*Account
+	q := fsc.Client.Collection("Account").Where("email", "==", account.Email)
+	fsc.NewRequest().QueryEntities(ctx, q, &accounts)()
+	if len(accounts) != 1 || !accounts[0].Loaded {
+		t.Errorf("the after load hook should have been called on the query result: %v", accounts)
+	}
+}
+
+type Contract struct {
+	ID        string
+	Title     string
+	DeletedAt *time.Time
+}
+
+func TestSoftDelete(t *testing.T) {
+	restoreClient(t)
+	fsc.DeletedAtKey = "DeletedAt"
+	testRunner(t, testSoftDelete_)
+}
+func testSoftDelete_(ctx context.Context, t *testing.T) {
+	contract := &Contract{Title: "Lease"}
+	fsc.NewRequest().CreateEntities(ctx, contract)()
+	defer fsc.NewRequest().HardDeleteEntities(ctx, contract)()
+
+	if err := fsc.NewRequest().DeleteEntities(ctx, contract)(); err != nil || contract.DeletedAt == nil {
+		t.Fatalf("the contract should have been soft deleted: %v", err)
+	}
+	var nfErr firestorm.NotFoundError
+	if _, err := fsc.NewRequest().GetEntities(ctx, &Contract{ID: contract.ID})(); !errors.As(err, &nfErr) {
+		t.Errorf("We expect a NotFoundError: %v", err)
+	}
+	loaded := &Contract{ID: contract.ID}
+	if _, err := fsc.NewRequest().IncludeDeleted().GetEntities(ctx, loaded)(); err != nil || loaded.DeletedAt == nil {
+		t.Errorf("the deleted contract should have been loaded: %v", err)
+	}
+
+	q := fsc.Client.Collection("Contract").Where("title", "==", "Lease")
+	var contracts []*Contract
+	fsc.NewRequest().QueryEntities(ctx, q, &contracts)()
+	if len(contracts) != 0 {
+		t.Errorf("the deleted contract should have been filtered: %v", contracts)
+	}
+	fsc.NewRequest().IncludeDeleted().QueryEntities(ctx, q, &contracts)()
+	if len(contracts) != 1 {
+		t.Errorf("the deleted contract should have been included: %v", contracts)
+	}
+
+	if err := fsc.NewRequest().RestoreEntities(ctx, contract)(); err != nil || contract.DeletedAt != nil {
+		t.Errorf("the contract should have been restored: %v", err)
+	}
+	if _, err := fsc.NewRequest().GetEntities(ctx, &Contract{ID: contract.ID})(); err != nil {
+		t.Errorf("the restored contract should have been loaded: %v", err)
+	}
+	contracts = nil
+	fsc.NewRequest().QueryEntities(ctx, q, &contracts)()
+	if len(contracts) != 1 {
+		t.Errorf("the restored contract should have been queried: %v", contracts)
+	}
+
+	// the deleted entities are filtered in firestore before the limit
+	deleted := &Contract{Title: "Lease"}
+	fsc.NewRequest().CreateEntities(ctx, deleted)()
+	defer fsc.NewRequest().HardDeleteEntities(ctx, deleted)()
+	fsc.NewRequest().DeleteEntities(ctx, deleted)()
+	contracts = nil
+	fsc.NewRequest().QueryEntities(ctx, q.Limit(1), &contracts)()
+	if len(contracts) != 1 || contracts[0].ID != contract.ID {
+		t.Errorf("the contract that is not deleted should have been queried: %v", contracts)
+	}
+
+	fsc.NewRequest().HardDeleteEntities(ctx, contract)()
+	if _, err := fsc.NewRequest().IncludeDeleted().GetEntities(ctx, &Contract{ID: contract.ID})(); !errors.As(err, &nfErr) {
+		t.Errorf("the contract should have been deleted: %v", err)
+	}
+}
+
+func TestDeleteTree(t *testing.T) {
+	testRunner(t, testDeleteTree_)
+}
+func testDeleteTree_(ctx context.Context, t *testing.T) {
+	garage := &Garage{Address: "Main street"}
+	fsc.NewRequest().CreateEntities(ctx, garage)()
+	// more cars than fit in a batch so the sub-collection is deleted in two batches
+	cars := make([]*TaggedCar, firestorm.MaxBatchSize+1)
+	for i := range cars {
+		cars[i] = &TaggedCar{Garage: garage, Make: "Toyota"}
+	}
+	fsc.NewRequest().CreateEntities(ctx, cars)()
+
+	var progress []int
+	if err := fsc.NewRequest().SetProgress(func(done int) { progress = append(progress, done) }).DeleteTree(ctx, garage)(); err != nil {
+		t.Fatalf("the garage should have been deleted: %v", err)
+	}
+	if diff := cmp.Diff([]int{firestorm.MaxBatchSize, len(cars), len(cars) + 1}, progress); diff != "" {
+		t.Errorf("we expect the progress of each batch of cars and the garage: %s", diff)
+	}
+
+	var nfErr firestorm.NotFoundError
+	if _, err := fsc.NewRequest().GetEntities(ctx, cars)(); !errors.As(err, &nfErr) || len(nfErr.Refs) != len(cars) {
+		t.Errorf("the cars should have been deleted: %v", err)
+	}
+	if _, err := fsc.NewRequest().GetEntities(ctx, garage)(); !errors.As(err, &nfErr) {
+		t.Errorf("the garage should have been deleted: %v", err)
+	}
+}
+
+func TestCascade(t *testing.T) {
+	testRunner(t, testCascade_)
+}
+func testCascade_(ctx context.Context, t *testing.T) {
+	john := &Person{Name: "John"}
+	mary := &Person{Name: "Mary", Spouse: john}
+	john.Spouse = mary
+	car := &Car{Make: "Toyota", Owner: john, Passengers: []Person{{Name: "Bob"}}}
+	if err := fsc.NewRequest().SetCascadePaths("owner.spouse", "passengers").SetAtomic(true).CreateEntities(ctx, car)(); err != nil {
+		t.Fatalf("the car should have been created with its references: %v", err)
+	}
+	defer cleanup(car, john, mary, &car.Passengers[0])
+	if john.ID == "" || mary.ID == "" || car.Passengers[0].ID == "" {
+		t.Errorf("the referenced entities should have ids: %v %v %v", john, mary, car.Passengers)
+	}
+
+	// existing references are updated
+	john.Name = "Johnny"
+	fsc.NewRequest().SetCascadePaths("owner").UpdateEntities(ctx, car)()
+
+	otherCar := &Car{ID: car.ID}
+	fsc.NewRequest().SetLoadPaths("owner", "owner.spouse", "passengers").GetEntities(createSessionCacheContext(), otherCar)()
+	if otherCar.Owner == nil || otherCar.Owner.Name != "Johnny" || otherCar.Owner.Spouse == nil || otherCar.Owner.Spouse.Name != "Mary" {
+		t.Errorf("the owner and spouse should have been saved: %v", otherCar.Owner)
+	}
+	if len(otherCar.Passengers) != 1 || otherCar.Passengers[0].Name != "Bob" {
+		t.Errorf("the passengers should have been saved: %v", otherCar.Passengers)
+	}
+}
+
+type Member struct {
+	ID      string
+	Name    string
+	Sponsor *Member
+}
+
+func (m *Member) BeforeSave(ctx context.Context) error {
+	if m.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+func TestCascadeFailure(t *testing.T) {
+	testRunner(t, testCascadeFailure_)
+}
+func testCascadeFailure_(ctx context.Context, t *testing.T) {
+	invalid := &Member{}
+	sponsor := &Member{Name: "Sponsor", Sponsor: invalid}
+	member := &Member{Name: "Member", Sponsor: sponsor}
+	err := fsc.NewRequest().SetCascadePaths("sponsor.sponsor").CreateEntities(ctx, member)()
+	defer cleanup(member, sponsor)
+
+	// the member and the sponsor depend on the invalid member
+	var multiErr firestorm.MultiError
+	if !errors.As(err, &multiErr) || len(multiErr.Errors) != 3 {
+		t.Fatalf("All the members should have failed: %v", err)
+	}
+	for _, e := range multiErr.Errors {
+		if (e.Entity == member) != (e.Index == 0) || e.Ref == nil || e.Ref.ID != e.Entity.(*Member).ID {
+			t.Errorf("The index and ref should point to the failed entity: %v", e)
+		}
+	}
+	var nfErr firestorm.NotFoundError
+	if _, err := fsc.NewRequest().GetEntities(ctx, []*Member{{ID: member.ID}, {ID: sponsor.ID}})(); !errors.As(err, &nfErr) || len(nfErr.Refs) != 2 {
+		t.Errorf("The member and the sponsor should not have been written: %v", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	testRunner(t, testListen_)
+}
+func testListen_(ctx context.Context, t *testing.T) {
+	owner := &Person{Name: "John"}
+	fsc.NewRequest().CreateEntities(ctx, owner)()
+	defer cleanup(owner)
+
+	lctx, cancel := context.WithCancel(ctx)
+	changes := make(chan firestorm.Change, 10)
+	var cars []*Car
+	query := fsc.NewRequest().ToCollection(&Car{}).Where("make", "==", "Listener")
+	stopped := fsc.NewRequest().SetLoadPaths("owner").ListenQuery(lctx, query, &cars, func(c []firestorm.Change) error {
+		for _, change := range c {
+			changes <- change
+		}
+		return nil
+	})
+	next := func() firestorm.Change {
+		select {
+		case c := <-changes:
+			return c
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for change")
+		}
+		return firestorm.Change{}
+	}
+
+	car := &Car{Make: "Listener", Owner: owner}
+	fsc.NewRequest().CreateEntities(ctx, car)()
+	c := next()
+	if c.Kind != firestorm.EntityAdded || c.Entity.(*Car).ID != car.ID || c.Entity.(*Car).Owner.Name != "John" {
+		t.Errorf("the car should have been added with the owner loaded: %v %+v", c.Kind, c.Entity)
+	}
+	if result := c.Result.([]*Car); len(result) != 1 || result[0] != c.Entity {
+		t.Errorf("the result should hold the added car: %v", result)
+	}
+	if cars != nil {
+		t.Errorf("the slice of the caller should not have been modified: %v", cars)
+	}
+
+	// the entity of the caller is not modified by the listener
+	listened := &Car{ID: car.ID}
+	entityChanges := make(chan firestorm.Change, 10)
+	entityStopped := fsc.NewRequest().ListenEntity(lctx, listened, func(c []firestorm.Change) error {
+		entityChanges <- c[0]
+		return nil
+	})
+	select {
+	case c := <-entityChanges:
+		if c.Kind != firestorm.EntityAdded || c.Entity == listened || c.Entity.(*Car).Make != "Listener" {
+			t.Errorf("the car should have been loaded into a new entity: %v %+v", c.Kind, c.Entity)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for change")
+	}
+	if listened.Make != "" {
+		t.Errorf("the entity of the caller should not have been modified: %+v", listened)
+	}
+
+	car.Year = time.Now()
+	fsc.NewRequest().UpdateEntities(ctx, car)()
+	if c := next(); c.Kind != firestorm.EntityModified || c.Entity.(*Car).Year.IsZero() {
+		t.Errorf("the car should have been modified: %v %+v", c.Kind, c.Entity)
+	}
+
+	fsc.NewRequest().DeleteEntities(ctx, car)()
+	if c := next(); c.Kind != firestorm.EntityRemoved || c.Entity.(*Car).ID != car.ID {
+		t.Errorf("the car should have been removed: %v %+v", c.Kind, c.Entity)
+	}
+
+	// a dangling reference does not stop the listener
+	dangling := &Car{Make: "Listener", Owner: &Person{ID: "DanglingListenerOwner"}}
+	fsc.NewRequest().CreateEntities(ctx, dangling)()
+	if c := next(); c.Kind != firestorm.EntityAdded || c.Entity.(*Car).ID != dangling.ID {
+		t.Errorf("the car should have been added without the owner: %v %+v", c.Kind, c.Entity)
+	}
+	fsc.NewRequest().DeleteEntities(ctx, dangling)()
+	if c := next(); c.Kind != firestorm.EntityRemoved || c.Entity.(*Car).ID != dangling.ID {
+		t.Errorf("the car should have been removed: %v %+v", c.Kind, c.Entity)
+	}
+
+	cancel()
+	if err := stopped(); err != nil {
+		t.Errorf("the listener should have stopped without error: %v", err)
+	}
+	if err := entityStopped(); err != nil {
+		t.Errorf("the entity listener should have stopped without error: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package firestormtests
+
+import (
+	"context"
+	"github.com/jschoedt/go-firestorm"
+	"testing"
+)
+
+func TestRepository(t *testing.T) {
+	testRunner(t, testRepository_)
+}
+func testRepository_(ctx context.Context, t *testing.T) {
+	cars := firestorm.NewRepository[Car](fsc)
+
+	car := &Car{Make: "Toyota"}
+	otherCar := &Car{Make: "Jeep"}
+	if err := cars.Create(ctx, car, otherCar)(); err != nil {
+		t.Errorf("cars should have been created: %v", err)
+	}
+	defer cleanup(car, otherCar)
+
+	// Read the entity by ID
+	result, err := cars.GetByID(ctx, car.ID)()
+	if err != nil || result.Make != "Toyota" {
+		t.Errorf("car should have name: Toyota but was: %v - %v", result, err)
+	}
+
+	// Read multiple entities
+	multi, err := cars.GetMulti(ctx, []*Car{{ID: car.ID}, {ID: otherCar.ID}})()
+	if err != nil || len(multi) != 2 {
+		t.Errorf("both cars should have been loaded: %v - %v", multi, err)
+	}
+
+	// Update the entity
+	car.Make = "Ford"
+	cars.Update(ctx, car)()
+
+	query := cars.Collection().Where("make", "==", "Ford")
+	found, err := cars.Query(ctx, query)()
+	if err != nil || len(found) != 1 || found[0].ID != car.ID {
+		t.Errorf("car was not found by search: %v - %v", found, err)
+	}
+
+	// Delete the entity
+	cars.Delete(ctx, car)()
+	if _, err := cars.Get(ctx, &Car{ID: car.ID})(); err == nil {
+		t.Errorf("We expect a notFoundError")
+	}
+}
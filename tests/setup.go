@@ -28,6 +28,19 @@ func testRunner(t *testing.T, f func(ctx context.Context, t *testing.T)) {
 	f(createSessionCacheContext(), t)
 }
 
+// restoreClient restores the settings of the shared client when the test ends so the tests do not depend on their order.
+// The cache policies are restored by the tests setting them
+func restoreClient(t *testing.T) {
+	c, logger := fsc.Cache, fsc.Logger
+	dirty, locking, deletedAt := fsc.DirtyTracking, fsc.OptimisticLocking, fsc.DeletedAtKey
+	created, updated, read := fsc.CreateTimeKey, fsc.UpdateTimeKey, fsc.ReadTimeKey
+	t.Cleanup(func() {
+		fsc.Cache, fsc.Logger = c, logger
+		fsc.DirtyTracking, fsc.OptimisticLocking, fsc.DeletedAtKey = dirty, locking, deletedAt
+		fsc.CreateTimeKey, fsc.UpdateTimeKey, fsc.ReadTimeKey = created, updated, read
+	})
+}
+
 func cleanup(entities ...interface{}) {
 	fsc.NewRequest().DeleteEntities(context.Background(), entities)()
 }
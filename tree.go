@@ -0,0 +1,120 @@
+package firestorm
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"google.golang.org/api/iterator"
+	"reflect"
+)
+
+// ProgressFunc is called with the number of documents processed so far by a long running operation. See Request.SetProgress
+type ProgressFunc func(done int)
+
+// deleteSubTree deletes the documents in the sub-collections of the document and their sub-collections. Each
+// sub-collection is streamed and its documents are deleted in batches of MaxBatchSize as they are read, each after
+// its own sub-collections. A document is left untouched if any of its sub-documents could not be deleted. The errors
+// of the documents that could not be deleted are returned along with the error that stopped the deletion if any
+func (fsc *FSClient) deleteSubTree(ctx context.Context, req *Request, ref *firestore.DocumentRef, index int, done *int) ([]EntityError, error) {
+	var errs []EntityError
+	cols := ref.Collections(ctx)
+	for {
+		col, err := cols.Next()
+		if err == iterator.Done {
+			return errs, nil
+		} else if err != nil {
+			return errs, err
+		}
+
+		var batch []write
+		flush := func() {
+			batchErrs := fsc.deleteBatch(ctx, batch)
+			errs = append(errs, batchErrs...)
+			*done += len(batch) - len(batchErrs)
+			req.reportProgress(*done)
+			batch = nil
+		}
+		docs := col.DocumentRefs(ctx) // includes the missing documents that only have sub-collections
+		for {
+			doc, err := docs.Next()
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				return errs, err
+			}
+			childErrs, err := fsc.deleteSubTree(ctx, req, doc, index, done)
+			errs = append(errs, childErrs...)
+			if err != nil {
+				return errs, err
+			}
+			if len(childErrs) > 0 {
+				continue
+			}
+			batch = append(batch, write{op: deleteOp, ref: doc, index: index})
+			if len(batch) == MaxBatchSize {
+				flush()
+			}
+		}
+		if len(batch) > 0 {
+			flush()
+		}
+	}
+}
+
+// deleteTrees deletes the entities and all documents in their sub-collections. The sub-collections are streamed
+// and deleted in batches before the entity. The entity is left untouched if any of its sub-documents could not be deleted.
+func (fsc *FSClient) deleteTrees(ctx context.Context, req *Request, sliceVal reflect.Value) FutureFunc {
+	hard := *req
+	hard.hardDelete = true
+	asyncFunc := func() error {
+		var errs []EntityError
+		done := 0
+		for i := 0; i < sliceVal.Len(); i++ {
+			entity := sliceVal.Index(i).Interface()
+			w, err := fsc.toDeleteWrite(ctx, &hard, entity)
+			if err != nil {
+				errs = append(errs, EntityError{Index: i, Entity: entity, Err: err})
+				continue
+			}
+			w.index = i
+
+			treeErrs, err := fsc.deleteSubTree(ctx, req, w.ref, i, &done)
+			errs = append(errs, treeErrs...)
+			if err != nil {
+				errs = append(errs, w.toError(err))
+				continue
+			}
+			if len(treeErrs) > 0 {
+				continue
+			}
+
+			if err := fsc.applyWrite(ctx, w); err != nil {
+				errs = append(errs, w.toError(err))
+				continue
+			}
+			done++
+			req.reportProgress(done)
+		}
+		return multiErrorOrNil(errs)
+	}
+	return runAsync(ctx, asyncFunc)
+}
+
+// deleteBatch deletes the batch. Inside a transaction the deletes are added to the transaction
+func (fsc *FSClient) deleteBatch(ctx context.Context, batch []write) []EntityError {
+	if _, ok := getTransaction(ctx); !ok {
+		return fsc.commitWrites(ctx, batch, false)
+	}
+	var errs []EntityError
+	for _, w := range batch {
+		if err := fsc.applyWrite(ctx, w); err != nil {
+			errs = append(errs, w.toError(err))
+		}
+	}
+	return errs
+}
+
+func (req *Request) reportProgress(done int) {
+	if req.progress != nil {
+		req.progress(done)
+	}
+}